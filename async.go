@@ -0,0 +1,147 @@
+package perfetto
+
+import (
+	"errors"
+	"fmt"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+)
+
+// -- { Slices nesting } --------------------------------
+
+var (
+	ErrNoOpenSlice    = errors.New("no open slice on the track")
+	ErrEndBeforeBegin = errors.New("slice ends before it begins")
+)
+
+// sliceStacks holds the begin timestamps of the slices that are open
+// on each track, keyed by track uuid.
+type sliceStacks map[uint64][]uint64
+
+// check checks that a slice end event matches a slice begin event on
+// the same track, and keeps the stacks up to date.
+func (ss *sliceStacks) check(e Event) error {
+	switch e.Type {
+	case pp.TrackEvent_TYPE_SLICE_BEGIN:
+		if *ss == nil {
+			*ss = make(sliceStacks)
+		}
+		(*ss)[e.TrackUuid] = append((*ss)[e.TrackUuid], e.Timestamp)
+	case pp.TrackEvent_TYPE_SLICE_END:
+		stack := (*ss)[e.TrackUuid]
+		if len(stack) == 0 {
+			return fmt.Errorf("%w (track %v, ts %v)", ErrNoOpenSlice, e.TrackUuid, e.Timestamp)
+		}
+		if begin := stack[len(stack)-1]; e.Timestamp < begin {
+			return fmt.Errorf("%w (track %v, begin %v, end %v)", ErrEndBeforeBegin, e.TrackUuid, begin, e.Timestamp)
+		}
+		if len(stack) == 1 {
+			delete(*ss, e.TrackUuid)
+		} else {
+			(*ss)[e.TrackUuid] = stack[:len(stack)-1]
+		}
+	}
+	return nil
+}
+
+// -- { Async Slices } --------------------------------
+
+// AsyncSlice is a slice that can end on a different goroutine than the
+// one that started it, and that can overlap other slices of its parent
+// track. It's emitted on a child track of the parent.
+type AsyncSlice struct {
+	Track BasicTrack // the child track the slice is emitted on
+
+	trace *Trace
+	lane  *asyncLane
+	gen   uint64 // generation of the lane when the slice began
+}
+
+// asyncLane is a child track used for async slices. Slices that don't
+// overlap share the same lane.
+type asyncLane struct {
+	track BasicTrack
+	busy  bool   // whether a slice is open on the lane
+	end   uint64 // end timestamp of the last slice on the lane
+	gen   uint64 // number of slices begun on the lane
+}
+
+// asyncLanes holds the lanes of each parent track, keyed by the parent
+// track uuid.
+type asyncLanes map[uint64][]*asyncLane
+
+// BeginAsync starts an async slice under the parent track. The slice
+// is emitted on a child track of parent, which is reused by later
+// async slices once this one has ended. The returned AsyncSlice can
+// be ended from any goroutine. BeginAsync returns an error, and no
+// slice is started, if the begin event can't be added.
+func (t *Trace) BeginAsync(parent Track, ts uint64, name string, ann ...Annotations) (AsyncSlice, error) {
+	e := NewEvent(parent, pp.TrackEvent_TYPE_SLICE_BEGIN, ts, name, nil, ann...)
+	t.apply(&e)
+
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	if !t.st.categories.eventEnabled(e.Categories) {
+		return AsyncSlice{}, nil
+	}
+	if err := t.validate(e); err != nil {
+		return AsyncSlice{}, err
+	}
+	t.setCaller(&e, 0)
+
+	lane := t.asyncLane(parent, ts)
+	e.TrackUuid = lane.track.Uuid
+	if err := t.add(e); err != nil {
+		return AsyncSlice{}, err
+	}
+	lane.busy = true
+	lane.gen++
+	return AsyncSlice{Track: lane.track, trace: t, lane: lane, gen: lane.gen}, nil
+}
+
+// asyncLane returns a lane of the parent track that is free at ts,
+// adding a new one to the trace if there's none.
+func (t *Trace) asyncLane(parent Track, ts uint64) *asyncLane {
+	lanes := t.st.lanes[parent.GetUuid()]
+	for _, l := range lanes {
+		if !l.busy && l.end <= ts {
+			return l
+		}
+	}
+
+	tr := NewTrack(parent.GetName())
+	tr.ParentUuid = parent.GetUuid()
+	t.st.reg.reserve(&tr)
+	t.emitTrack(tr.Emit())
+	t.st.reg.add(tr)
+	l := &asyncLane{track: tr}
+	if t.st.lanes == nil {
+		t.st.lanes = make(asyncLanes)
+	}
+	t.st.lanes[parent.GetUuid()] = append(lanes, l)
+	return l
+}
+
+// End ends the async slice. It returns an error if the slice has
+// already ended, or if it began after ts.
+func (s AsyncSlice) End(ts uint64) error {
+	if s.trace == nil {
+		return nil // the slice was in a disabled category
+	}
+
+	e := NewEvent(s.Track, pp.TrackEvent_TYPE_SLICE_END, ts, "", nil)
+	s.trace.apply(&e)
+
+	t := s.trace
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	if !s.lane.busy || s.lane.gen != s.gen {
+		return fmt.Errorf("%w (track %v, ts %v)", ErrNoOpenSlice, s.Track.Uuid, ts)
+	}
+	if err := t.add(e); err != nil {
+		return err
+	}
+	s.lane.busy = false
+	s.lane.end = ts
+	return nil
+}
@@ -0,0 +1,145 @@
+package perfetto
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+)
+
+func TestSliceNesting(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	t2 := trace.AddTrack("track #2")
+
+	trace.StartSlice(t1, 100, "outer")
+	trace.StartSlice(t1, 150, "inner")
+	trace.StartSlice(t2, 120, "other track")
+	if err := trace.EndSlice(t1, 140); !errors.Is(err, ErrEndBeforeBegin) {
+		t.Errorf("For %s\ngot %v\nexp %v", "early end", err, ErrEndBeforeBegin)
+	}
+	for _, ts := range []uint64{200, 300} {
+		if err := trace.EndSlice(t1, ts); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if err := trace.EndSlice(t1, 400); !errors.Is(err, ErrNoOpenSlice) {
+		t.Errorf("For %s\ngot %v\nexp %v", "unbalanced end", err, ErrNoOpenSlice)
+	}
+	if err := trace.EndSlice(t2, 400); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Rejected end events are not added to the trace
+	td := ReadBack(t, trace)
+	AssertEq("Events", t, len(td.Events), 6)
+}
+
+func TestAsyncSlices(t *testing.T) {
+	trace := NewTrace()
+	p := trace.AddProcess(1, "process #1")
+
+	// Two overlapping slices need two lanes, the third one reuses the
+	// first lane.
+	s1 := mustBeginAsync(t, trace, p, 100, "request 1")
+	s2 := mustBeginAsync(t, trace, p, 150, "request 2")
+	if err := s1.End(200); err != nil {
+		t.Fatal(err)
+	}
+	s3 := mustBeginAsync(t, trace, p, 250, "request 3")
+	if err := s1.End(260); !errors.Is(err, ErrNoOpenSlice) {
+		t.Errorf("For %s\ngot %v\nexp %v", "end of a reused lane", err, ErrNoOpenSlice)
+	}
+	if err := s2.End(300); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3.End(350); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3.End(400); !errors.Is(err, ErrNoOpenSlice) {
+		t.Errorf("For %s\ngot %v\nexp %v", "double end", err, ErrNoOpenSlice)
+	}
+
+	AssertNeq("lanes", t, s1.Track.Uuid, s2.Track.Uuid)
+	AssertEq("lanes", t, s1.Track.Uuid, s3.Track.Uuid)
+
+	td := ReadBack(t, trace)
+	AssertEq("Tracks", t, len(td.Tracks), 2)
+	for _, tr := range td.Tracks {
+		AssertEq("ParentUuid", t, tr.ParentUuid, p.Uuid)
+		AssertEq("Name", t, tr.Name, "process #1")
+	}
+	AssertEq("Events", t, len(td.Events), 6)
+	AssertEvent(t, td.Events[0], Event{
+		Timestamp: 100, Name: "request 1", Type: pp.TrackEvent_TYPE_SLICE_BEGIN, TrackUuid: s1.Track.Uuid,
+	})
+	AssertEvent(t, td.Events[5], Event{
+		Timestamp: 350, Type: pp.TrackEvent_TYPE_SLICE_END, TrackUuid: s3.Track.Uuid,
+	})
+}
+
+// Async slices can end on other goroutines
+func TestAsyncSlicesConcurrent(t *testing.T) {
+	trace := NewTrace()
+	p := trace.AddProcess(1, "process #1")
+
+	var wg sync.WaitGroup
+	for i := range uint64(10) {
+		s := mustBeginAsync(t, trace, p, i, "request")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.End(100 + i); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	td := ReadBack(t, trace)
+	AssertEq("Tracks", t, len(td.Tracks), 10)
+	AssertEq("Events", t, len(td.Events), 20)
+}
+
+func TestAsyncSliceDisabled(t *testing.T) {
+	trace := NewTrace()
+	p := trace.AddProcess(1, "process #1")
+	s, err := trace.With(Categories("debug")).BeginAsync(p, 100, "request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.End(200); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	td := ReadBack(t, trace)
+	AssertEq("Tracks", t, len(td.Tracks), 0)
+	AssertEq("Events", t, len(td.Events), 0)
+}
+
+// A begin that can't be added doesn't take a lane
+func TestAsyncSliceErrors(t *testing.T) {
+	trace := NewTrace()
+	p := trace.AddProcess(1, "process #1")
+	if _, err := trace.With(OnClock(ClockMonotonic)).BeginAsync(p, 100, "request"); !errors.Is(err, ErrUnknownClock) {
+		t.Errorf("For %s\ngot %v\nexp %v", "unknown clock", err, ErrUnknownClock)
+	}
+	s := mustBeginAsync(t, trace, p, 100, "request")
+	if err := s.End(200); err != nil {
+		t.Fatal(err)
+	}
+
+	td := ReadBack(t, trace)
+	AssertEq("Tracks", t, len(td.Tracks), 1)
+	AssertEq("Events", t, len(td.Events), 2)
+}
+
+func mustBeginAsync(t *testing.T, trace Trace, parent Track, ts uint64, name string) AsyncSlice {
+	t.Helper()
+	s, err := trace.BeginAsync(parent, ts, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
@@ -0,0 +1,179 @@
+package perfetto
+
+import (
+	"encoding/binary"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+)
+
+// -- { Callstacks } --------------------------------
+
+// Frame is a frame of a callstack.
+type Frame struct {
+	Function string // fully qualified function name
+	PC       uint64 // program counter
+	Mapping  string // path of the executable
+}
+
+// callstackConfig decides which events get a callstack.
+type callstackConfig struct {
+	depth int      // max number of frames, 0 if capture is disabled
+	cats  []string // categories and patterns, all events if empty
+}
+
+// CaptureCallstacks makes the trace capture the callstack of the
+// callers of StartSlice, InstantEvent, Slice, BeginAsync and Log,
+// with at most depth frames. If categories are given, only the events
+// in a matching category get a callstack; patterns are supported as
+// in EnableCategories. A depth of zero disables the capture.
+//
+// The callstacks are interned, with their frames, function names and
+// mappings, and attached to the events through a "callstack" debug
+// annotation: a dict with the function names of the frames, innermost
+// first, and the iid of the interned callstack, that ReadTrace
+// resolves to the Callstack field of the event.
+//
+// The bundled trace proto predates TrackEvent.callstack_iid, so the
+// UI doesn't link the interned callstacks to the events, and only
+// shows the annotation. The frames can't be symbolized either: their
+// relative pc is the absolute pc, and the mapping of the executable
+// has no address range or build id.
+func (t *Trace) CaptureCallstacks(depth int, categories ...string) {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	t.st.callstacks = callstackConfig{depth: max(depth, 0), cats: categories}
+}
+
+// enabled reports whether an event with the given categories gets a
+// callstack.
+func (c callstackConfig) enabled(cats []string) bool {
+	if c.depth == 0 {
+		return false
+	}
+	if len(c.cats) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(cats, func(cat string) bool {
+		return slices.Contains(c.cats, cat) || matchAny(c.cats, cat)
+	})
+}
+
+// callstackAnnotation is the name of the debug annotation that holds
+// the callstack of an event.
+const callstackAnnotation = "callstack"
+
+// stacks caches the frames of the callstacks resolved so far, keyed
+// by stackKey.
+var stacks sync.Map // string -> []Frame
+
+// executable returns the path of the executable, used as the mapping
+// of all the frames.
+var executable = sync.OnceValue(func() string {
+	path, _ := os.Executable()
+	return path
+})
+
+// stackKey returns a string that identifies a callstack.
+func stackKey(pcs []uintptr) string {
+	b := make([]byte, 0, 8*len(pcs))
+	for _, pc := range pcs {
+		b = binary.LittleEndian.AppendUint64(b, uint64(pc))
+	}
+	return string(b)
+}
+
+// resolveStack returns the frames of the callstack, bottom frame
+// first.
+func resolveStack(key string, pcs []uintptr) []Frame {
+	if fs, ok := stacks.Load(key); ok {
+		return fs.([]Frame)
+	}
+	var fs []Frame
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		fs = append(fs, Frame{Function: f.Function, PC: uint64(f.PC), Mapping: executable()})
+		if !more {
+			break
+		}
+	}
+	slices.Reverse(fs)
+	stacks.Store(key, fs)
+	return fs
+}
+
+// callstackAnnotation returns the annotation of the callstack,
+// interning it and its frames if needed.
+func (s *sequence) callstackAnnotation(pcs []uintptr) Annotations {
+	key := stackKey(pcs)
+	frames := resolveStack(key, pcs)
+	functions := make([]string, len(frames))
+	for i, f := range frames {
+		functions[len(frames)-1-i] = f.Function
+	}
+	return Annotations{{K: callstackAnnotation, V: Annotations{
+		{K: "functions", V: functions},
+		{K: "iid", V: s.callstackIid(key, frames)},
+	}}}
+}
+
+// callstackIid returns the iid of the callstack, interning it and its
+// frames if needed.
+func (s *sequence) callstackIid(key string, frames []Frame) uint64 {
+	if iid, ok := s.interning.Callstacks[key]; ok {
+		return iid
+	}
+
+	var ids []uint64
+	for _, f := range frames {
+		ids = append(ids, s.frameIid(f))
+	}
+	iid, _ := intern(s.interning.Callstacks, &s.interning.NextCallstackId, key)
+	d := s.internedData()
+	d.Callstacks = append(d.Callstacks, &pp.Callstack{Iid: proto.Uint64(iid), FrameIds: ids})
+	return iid
+}
+
+// frameIid returns the iid of the frame, interning it and its
+// function name and mapping if needed.
+func (s *sequence) frameIid(f Frame) uint64 {
+	iid, ok := intern(s.interning.Frames, &s.interning.NextFrameId, f)
+	if ok {
+		d := s.internedData()
+		d.Frames = append(d.Frames, &pp.Frame{
+			Iid:            proto.Uint64(iid),
+			FunctionNameId: proto.Uint64(s.functionNameIid(f.Function)),
+			MappingId:      proto.Uint64(s.mappingIid(f.Mapping)),
+			RelPc:          proto.Uint64(f.PC),
+		})
+	}
+	return iid
+}
+
+func (s *sequence) functionNameIid(name string) uint64 {
+	iid, ok := intern(s.interning.FunctionNames, &s.interning.NextFunctionNameId, name)
+	if ok {
+		d := s.internedData()
+		d.FunctionNames = append(d.FunctionNames, &pp.InternedString{Iid: proto.Uint64(iid), Str: []byte(name)})
+	}
+	return iid
+}
+
+// mappingIid returns the iid of the mapping of the executable with the
+// given path. The path is interned in the mapping paths, with the same
+// iid.
+func (s *sequence) mappingIid(path string) uint64 {
+	iid, ok := intern(s.interning.Mappings, &s.interning.NextMappingId, path)
+	if ok {
+		d := s.internedData()
+		d.MappingPaths = append(d.MappingPaths, &pp.InternedString{Iid: proto.Uint64(iid), Str: []byte(path)})
+		d.Mappings = append(d.Mappings, &pp.Mapping{Iid: proto.Uint64(iid), PathStringIds: []uint64{iid}})
+	}
+	return iid
+}
@@ -0,0 +1,109 @@
+package perfetto
+
+import (
+	"strings"
+	"testing"
+)
+
+//go:noinline
+func callstackHelper(trace *Trace, track Track, ts uint64) {
+	trace.InstantEvent(track, ts, "instant")
+}
+
+func TestCallstacks(t *testing.T) {
+	for _, feat := range []Features{DefaultFeatures, {IncrementalTS: true}} {
+		trace := NewTrace(feat)
+		t1 := trace.AddTrack("track #1")
+		trace.CaptureCallstacks(4)
+		for i := range uint64(2) {
+			callstackHelper(&trace, t1, 100*i)
+		}
+
+		tr := RoundTrip(t, trace)
+		AssertEq("interned callstacks", t, len(tr.Packet[2].GetInternedData().GetCallstacks()), 1)
+		AssertEq("interned frames", t, len(tr.Packet[2].GetInternedData().GetFrames()), 4)
+		AssertEq("interned callstacks", t, len(tr.Packet[3].GetInternedData().GetCallstacks()), 0)
+
+		td := ReadBack(t, trace)
+		for _, e := range td.Events {
+			AssertEq("frames", t, len(e.Callstack), 4)
+			AssertEq("Ann", t, len(e.Ann), 0)
+			top := e.Callstack[len(e.Callstack)-2:]
+			if !strings.HasSuffix(top[0].Function, "TestCallstacks") || !strings.HasSuffix(top[1].Function, "callstackHelper") {
+				t.Errorf("unexpected top frames %v", top)
+			}
+			AssertNeq("Mapping", t, top[1].Mapping, "")
+		}
+	}
+}
+
+// The function names of the callstack are readable in the UI,
+// innermost first
+func TestCallstacksAnnotation(t *testing.T) {
+	trace := NewTrace(Features{})
+	t1 := trace.AddTrack("track #1")
+	trace.CaptureCallstacks(4)
+	callstackHelper(&trace, t1, 100)
+
+	for _, p := range RoundTrip(t, trace).Packet {
+		if p.GetTrackEvent() == nil {
+			continue
+		}
+		da := p.GetTrackEvent().GetDebugAnnotations()[0]
+		AssertEq("Name", t, da.GetName(), "callstack")
+		functions := da.GetDictEntries()[0]
+		AssertEq("Name", t, functions.GetName(), "functions")
+		AssertEq("Frames", t, len(functions.GetArrayValues()), 4)
+		if f := functions.GetArrayValues()[0].GetStringValue(); !strings.HasSuffix(f, "callstackHelper") {
+			t.Errorf("For %s\ngot %v\nexp %v", "innermost frame", f, "callstackHelper")
+		}
+	}
+}
+
+// Only the events in the configured categories get a callstack
+func TestCallstacksCategories(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	trace.CaptureCallstacks(16, "net.*")
+	trace.With(Categories("net.http")).StartSlice(t1, 100, "request")
+	trace.EndSlice(t1, 200)
+	trace.With(Categories("io")).InstantEvent(t1, 300, "read")
+	trace.InstantEvent(t1, 400, "no category")
+	trace.CaptureCallstacks(0)
+	trace.With(Categories("net.http")).InstantEvent(t1, 500, "disabled")
+
+	td := ReadBack(t, trace)
+	for i, exp := range []bool{true, false, false, false, false} {
+		AssertEq("has callstack", t, td.Events[i].Callstack != nil, exp)
+	}
+}
+
+// Events in disabled categories don't pay for the callstack
+func TestCallstacksDisabledCategory(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	trace.DisableCategories("debug")
+	debug := trace.With(Categories("debug"))
+	instant := func() { debug.InstantEvent(t1, 100, "instant") }
+	allocs := testing.AllocsPerRun(100, instant)
+	trace.CaptureCallstacks(16)
+	AssertEq("allocs", t, testing.AllocsPerRun(100, instant), allocs)
+	AssertEq("Events", t, len(ReadBack(t, trace).Events), 0)
+}
+
+// User annotations named like the callstack one are read back as is
+func TestCallstacksUserAnnotation(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	trace.StartSlice(t1, 100, "a", Annotations{{"callstack", Annotations{{"iid", 1}}}})
+	trace.EndSlice(t1, 200)
+	trace.CaptureCallstacks(4)
+	trace.StartSlice(t1, 300, "b", Annotations{{"callstack", "user"}})
+	trace.EndSlice(t1, 400)
+
+	td := ReadBack(t, trace)
+	AssertEq("Ann", t, len(td.Events[0].Ann), 1)
+	AssertEq("Callstack", t, td.Events[0].Callstack == nil, true)
+	AssertEq("Ann", t, td.Events[2].Ann[0].V, "user")
+	AssertEq("Callstack", t, td.Events[2].Callstack != nil, true)
+}
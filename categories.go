@@ -0,0 +1,113 @@
+package perfetto
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// -- { Categories } --------------------------------
+
+// Categories returns an EventOption that adds the given categories to
+// an event.
+func Categories(cats ...string) EventOption {
+	return func(e *Event) {
+		e.Categories = slices.Concat(e.Categories, cats)
+	}
+}
+
+// categoryFilter decides which categories of events are added to the
+// trace. Patterns can use the wildcards supported by path.Match, as
+// in "net.*".
+type categoryFilter struct {
+	enabled  []string        // explicitly enabled categories and patterns
+	disabled []string        // explicitly disabled categories and patterns
+	cache    map[string]bool // categories already checked
+}
+
+// EnableCategories enables the events in the categories matching the
+// given names or patterns.
+func (t *Trace) EnableCategories(patterns ...string) {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	f := &t.st.categories
+	f.disabled = slices.DeleteFunc(f.disabled, func(p string) bool { return slices.Contains(patterns, p) })
+	f.enabled = append(f.enabled, patterns...)
+	f.cache = nil
+}
+
+// DisableCategories disables the events in the categories matching the
+// given names or patterns. Disabled events are dropped when they are
+// added to the trace.
+func (t *Trace) DisableCategories(patterns ...string) {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	f := &t.st.categories
+	f.enabled = slices.DeleteFunc(f.enabled, func(p string) bool { return slices.Contains(patterns, p) })
+	f.disabled = append(f.disabled, patterns...)
+	f.cache = nil
+}
+
+// CategoryEnabled reports whether events in the given category are
+// added to the trace. The rules are the same used by perfetto, from
+// highest to lowest priority:
+//
+//  1. categories explicitly enabled by name are enabled;
+//  2. categories explicitly disabled by name are disabled;
+//  3. categories matching an enabled pattern are enabled;
+//  4. categories matching a disabled pattern are disabled;
+//  5. the "debug" category and the ones starting with "debug." are
+//     disabled;
+//  6. everything else is enabled.
+func (t *Trace) CategoryEnabled(cat string) bool {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	return t.st.categories.isEnabled(cat)
+}
+
+func (f *categoryFilter) isEnabled(cat string) bool {
+	enabled, ok := f.cache[cat]
+	if !ok {
+		enabled = f.check(cat)
+		if f.cache == nil {
+			f.cache = make(map[string]bool)
+		}
+		f.cache[cat] = enabled
+	}
+	return enabled
+}
+
+func (f *categoryFilter) check(cat string) bool {
+	switch {
+	case slices.Contains(f.enabled, cat):
+		return true
+	case slices.Contains(f.disabled, cat):
+		return false
+	case matchAny(f.enabled, cat):
+		return true
+	case matchAny(f.disabled, cat):
+		return false
+	default:
+		return cat != "debug" && !strings.HasPrefix(cat, "debug.")
+	}
+}
+
+func matchAny(patterns []string, cat string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, cat); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// eventEnabled reports whether an event with the given categories
+// should be added to the trace. Events without categories are always
+// enabled, and events with many categories are enabled if any of them
+// is.
+func (f *categoryFilter) eventEnabled(cats []string) bool {
+	if len(cats) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(cats, f.isEnabled)
+}
@@ -0,0 +1,83 @@
+package perfetto
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCategories(t *testing.T) {
+	for _, feat := range []Features{DefaultFeatures, {IncrementalTS: true}} {
+		trace := NewTrace(feat)
+		t1 := trace.AddTrack("track #1")
+		net := trace.With(Categories("net", "io"))
+		net.StartSlice(t1, 100, "read")
+		net.EndSlice(t1, 200)
+		trace.InstantEvent(t1, 300, "no category")
+
+		tr := RoundTrip(t, trace)
+		if feat.Interning {
+			AssertEq("categories", t, len(tr.Packet[2].GetTrackEvent().GetCategories()), 0)
+			AssertEq("category iids", t, len(tr.Packet[2].GetTrackEvent().GetCategoryIids()), 2)
+			AssertEq("interned categories", t, len(tr.Packet[2].GetInternedData().GetEventCategories()), 2)
+			AssertEq("interned categories", t, len(tr.Packet[3].GetInternedData().GetEventCategories()), 0)
+		}
+
+		td := ReadBack(t, trace)
+		AssertEq("Events", t, len(td.Events), 3)
+		for i, exp := range [][]string{{"net", "io"}, {"net", "io"}, nil} {
+			if got := td.Events[i].Categories; !slices.Equal(got, exp) {
+				t.Errorf("For %s\ngot %v\nexp %v", "Categories", got, exp)
+			}
+		}
+	}
+}
+
+func TestCategoryFilter(t *testing.T) {
+	trace := NewTrace()
+	for cat, exp := range map[string]bool{
+		"net": true, "debug": false, "debug.gc": false, "debugger": true,
+	} {
+		AssertEq("default "+cat, t, trace.CategoryEnabled(cat), exp)
+	}
+
+	trace.DisableCategories("*")
+	trace.EnableCategories("net.*", "debug.gc")
+	for cat, exp := range map[string]bool{
+		"net.http": true, "net": false, "io": false, "debug.gc": true, "debug": false,
+	} {
+		AssertEq("configured "+cat, t, trace.CategoryEnabled(cat), exp)
+	}
+
+	// Exact names take precedence over patterns
+	trace.DisableCategories("net.dns")
+	AssertEq("net.dns", t, trace.CategoryEnabled("net.dns"), false)
+	AssertEq("net.http", t, trace.CategoryEnabled("net.http"), true)
+	trace.EnableCategories("net.dns")
+	AssertEq("net.dns", t, trace.CategoryEnabled("net.dns"), true)
+}
+
+// Events in disabled categories are dropped, including the ones added
+// through other handles
+func TestDisabledCategories(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	seq := trace.NewSequence()
+	trace.DisableCategories("io")
+
+	for _, tr := range []Trace{trace, seq} {
+		dbg := tr.With(Categories("debug"))
+		dbg.StartSlice(t1, 100, "debug func")
+		dbg.EndSlice(t1, 200)
+		tr.With(Categories("io")).InstantEvent(t1, 300, "io")
+		tr.With(Categories("io", "net")).InstantEvent(t1, 400, "io and net")
+		tr.InstantEvent(t1, 500, "no category")
+	}
+
+	td := ReadBack(t, trace)
+	AssertEq("Events", t, len(td.Events), 4)
+	for _, e := range td.Events {
+		if e.Name != "io and net" && e.Name != "no category" {
+			t.Errorf("unexpected event %q", e.Name)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package perfetto
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// -- { Clock } --------------------------------
+
+// A Clock is the source of time of the Trace methods that don't take
+// a timestamp, like Begin and Instant. Timestamps are nanoseconds
+// since the trace was created, as measured by the clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the default Clock. The times it returns carry a
+// monotonic reading, so timestamps are not affected by changes of
+// the wall clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Now returns the current timestamp, read from the clock of the trace.
+func (t *Trace) Now() uint64 {
+	return t.Timestamp(t.st.clock.Now())
+}
+
+// Timestamp returns the timestamp of tm, which is the time elapsed
+// since the trace was created. Times before the creation of the trace
+// have timestamp zero.
+func (t *Trace) Timestamp(tm time.Time) uint64 {
+	return uint64(max(tm.Sub(t.st.epoch), 0))
+}
+
+// An Ender ends a slice started by Begin.
+type Ender struct {
+	trace *Trace
+	track Track
+	err   error // error of the begin event, if it was rejected
+}
+
+// Begin starts a slice on the track at the current time, and returns
+// an Ender that ends it:
+//
+//	defer trace.Begin(track, "work").End()
+//
+// If the slice can't be started, the error is returned by the Err and
+// End methods of the Ender.
+func (t *Trace) Begin(track Track, name string, ann ...Annotations) Ender {
+	err := t.addCaller(NewEvent(track, pp.TrackEvent_TYPE_SLICE_BEGIN, t.Now(), name, nil, ann...))
+	return Ender{trace: t, track: track, err: err}
+}
+
+// Err returns the error of the start of the slice, if it was rejected.
+func (e Ender) Err() error {
+	return e.err
+}
+
+// End ends the slice at the current time. It returns an error if the
+// slice has already ended, or if it was never started.
+func (e Ender) End() error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.trace.EndSlice(e.track, e.trace.Now())
+}
+
+// Instant adds an instant event to the track at the current time. It
+// returns an error if the event can't be added.
+func (t *Trace) Instant(track Track, name string, ann ...Annotations) error {
+	return t.addCaller(NewEvent(track, pp.TrackEvent_TYPE_INSTANT, t.Now(), name, nil, ann...))
+}
+
+// StartSliceAt is like StartSlice, with a time.Time.
+func (t *Trace) StartSliceAt(track Track, tm time.Time, name string, ann ...Annotations) error {
+	return t.addCaller(NewEvent(track, pp.TrackEvent_TYPE_SLICE_BEGIN, t.Timestamp(tm), name, nil, ann...))
+}
+
+// EndSliceAt is like EndSlice, with a time.Time.
+func (t *Trace) EndSliceAt(track Track, tm time.Time) error {
+	return t.EndSlice(track, t.Timestamp(tm))
+}
+
+// NewValueAt is like NewValue, with a time.Time.
+func (t *Trace) NewValueAt(track Counter, tm time.Time, val int64) error {
+	return t.NewValue(track, t.Timestamp(tm), val)
+}
+
+// -- { Clock domains } --------------------------------
+
+// A ClockID identifies a clock. Ids below 64 are the builtin clocks
+// of perfetto, ids from 64 to 127 are reserved for the clocks of
+// packet sequences (like CustomClockID), and user-defined clocks use
+// ids from 128.
+type ClockID uint32
+
+const (
+	ClockRealtime     = ClockID(pp.BuiltinClock_BUILTIN_CLOCK_REALTIME)
+	ClockMonotonic    = ClockID(pp.BuiltinClock_BUILTIN_CLOCK_MONOTONIC)
+	ClockMonotonicRaw = ClockID(pp.BuiltinClock_BUILTIN_CLOCK_MONOTONIC_RAW)
+	ClockBoottime     = ClockID(pp.BuiltinClock_BUILTIN_CLOCK_BOOTTIME)
+)
+
+// ErrUnknownClock is returned for events on a clock that is not a
+// domain of the trace.
+var ErrUnknownClock = errors.New("clock is not a domain of the trace")
+
+// A ClockDomain is a clock that events can be timestamped on, with the
+// OnClock option. Domains are set with Features.Clocks, and the trace
+// emits clock snapshots that relate them to the trace timestamps, so
+// that the UI can place all the events on a single timeline.
+//
+// The BOOTTIME domain anchors the trace: timestamp zero is mapped to
+// the boottime the trace was created at, instead of boottime zero,
+// and the timestamps of the trace are emitted as boottimes. Anchored
+// traces line up with the system traces recorded by traced, so the
+// two can be loaded together. Features.AnchorBoottime adds the system
+// BOOTTIME domain.
+type ClockDomain struct {
+	ID ClockID
+
+	// Read returns the current time of the clock, in units of
+	// UnitMultiplierNs nanoseconds. It can be nil for the builtin
+	// clocks, that are then read from the system.
+	Read func() uint64
+
+	UnitMultiplierNs uint64 // nanoseconds in a unit of the clock. If 0, 1
+}
+
+// OnClock returns an EventOption that sets the clock of the timestamp
+// of an event, which is then in the units of the clock. Events on
+// other clocks than the trace clock are not reordered by the
+// SortEvents feature, and a slice must begin and end on the same
+// clock. Events on a clock that is not a domain of the trace are not
+// added, and the methods adding them return ErrUnknownClock.
+func OnClock(id ClockID) EventOption {
+	return func(e *Event) {
+		e.Clock = id
+	}
+}
+
+// setClocks sets the clock domains of the trace, reading the anchor of
+// the trace if one of them is BOOTTIME. It panics on invalid domains.
+func (t *Trace) setClocks(domains []ClockDomain) {
+	for _, d := range domains {
+		switch {
+		case d.ID == 0 || d.ID >= 64 && d.ID < 128:
+			panic(fmt.Sprintf("perfetto: invalid clock domain id %d", d.ID))
+		case d.Read == nil && d.ID < 64:
+			read, ok := systemClockReader(d.ID)
+			if !ok {
+				panic(fmt.Sprintf("perfetto: builtin clock %d can't be read", d.ID))
+			}
+			d.Read = read
+		case d.Read == nil:
+			panic(fmt.Sprintf("perfetto: clock domain %d has no Read function", d.ID))
+		}
+		if d.ID == ClockBoottime {
+			t.st.boottime = d.Read() - t.Now()
+		}
+		t.st.clocks = append(t.st.clocks, d)
+	}
+}
+
+func (st *state) hasClock(id ClockID) bool {
+	return slices.ContainsFunc(st.clocks, func(d ClockDomain) bool { return d.ID == id })
+}
+
+// SnapshotClocks emits a snapshot of the clock domains of the trace,
+// reading them all together with the clock of the trace. Snapshots are
+// emitted when the trace is created and after a Reset, and also every
+// Features.SnapshotInterval if it's set. Taking them more often keeps
+// the events on other domains aligned when the clocks drift apart.
+func (t *Trace) SnapshotClocks() {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	t.snapshotClocks()
+}
+
+func (t *Trace) snapshotClocks() {
+	st := t.st
+	now := st.clock.Now()
+	ts := t.Timestamp(now)
+
+	// The BOOTTIME clock is the trace clock, so the reading of the
+	// BOOTTIME domain is only used to anchor the trace.
+	cs := &pp.ClockSnapshot{Clocks: []*pp.ClockSnapshot_Clock{{
+		ClockId:   proto.Uint32(uint32(ClockBoottime)),
+		Timestamp: proto.Uint64(st.boottime + ts),
+	}}}
+	if !st.hasClock(ClockRealtime) {
+		cs.Clocks = append(cs.Clocks, &pp.ClockSnapshot_Clock{
+			ClockId:   proto.Uint32(uint32(ClockRealtime)),
+			Timestamp: proto.Uint64(uint64(now.UnixNano())),
+		})
+	}
+	for _, d := range st.clocks {
+		if d.ID == ClockBoottime {
+			continue
+		}
+		c := &pp.ClockSnapshot_Clock{
+			ClockId:   proto.Uint32(uint32(d.ID)),
+			Timestamp: proto.Uint64(d.Read()),
+		}
+		if d.UnitMultiplierNs > 1 {
+			c.UnitMultiplierNs = proto.Uint64(d.UnitMultiplierNs)
+		}
+		cs.Clocks = append(cs.Clocks, c)
+	}
+	t.emit(&pp.TracePacket{
+		Data:                            &pp.TracePacket_ClockSnapshot{ClockSnapshot: cs},
+		OptionalTrustedPacketSequenceId: &pp.TracePacket_TrustedPacketSequenceId{t.seq.id},
+	})
+	st.nextSnap = ts + uint64(t.features.SnapshotInterval)
+}
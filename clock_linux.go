@@ -0,0 +1,28 @@
+package perfetto
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Linux clock ids of the builtin clocks
+var linuxClocks = map[ClockID]uintptr{
+	ClockRealtime:     0, // CLOCK_REALTIME
+	ClockMonotonic:    1, // CLOCK_MONOTONIC
+	ClockMonotonicRaw: 4, // CLOCK_MONOTONIC_RAW
+	ClockBoottime:     7, // CLOCK_BOOTTIME
+}
+
+// systemClockReader returns a function that reads the builtin clock
+// with clock_gettime.
+func systemClockReader(id ClockID) (func() uint64, bool) {
+	cid, ok := linuxClocks[id]
+	if !ok {
+		return nil, false
+	}
+	return func() uint64 {
+		var ts syscall.Timespec
+		syscall.Syscall(syscall.SYS_CLOCK_GETTIME, cid, uintptr(unsafe.Pointer(&ts)), 0)
+		return uint64(ts.Nano())
+	}, true
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package perfetto
+
+import "time"
+
+var processStart = time.Now()
+
+// systemClockReader returns a function that reads the builtin clock.
+// Outside Linux, the monotonic clocks are approximated by the time
+// since the process started, so the traces can't be aligned with
+// system traces.
+func systemClockReader(id ClockID) (func() uint64, bool) {
+	switch id {
+	case ClockRealtime:
+		return func() uint64 { return uint64(time.Now().UnixNano()) }, true
+	case ClockMonotonic, ClockMonotonicRaw, ClockBoottime:
+		return func() uint64 { return uint64(time.Since(processStart)) }, true
+	}
+	return nil, false
+}
@@ -0,0 +1,228 @@
+package perfetto
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+)
+
+// fakeClock is a Clock that only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestClock(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	feat := DefaultFeatures
+	feat.Clock = clock
+	trace := NewTrace(feat)
+	t1 := trace.AddTrack("track #1")
+	c := trace.AddCounter("counter", "")
+
+	clock.Advance(100)
+	end := trace.Begin(t1, "work")
+	clock.Advance(50)
+	trace.Instant(t1, "instant")
+	clock.Advance(50)
+	if err := end.End(); err != nil {
+		t.Fatal(err)
+	}
+	trace.StartSliceAt(t1, clock.now.Add(100), "at")
+	trace.EndSliceAt(t1, clock.now.Add(200))
+	trace.NewValueAt(c, clock.now.Add(300), 7)
+	trace.InstantEvent(t1, trace.Timestamp(clock.now.Add(-time.Hour)), "before the trace")
+
+	// The snapshot maps timestamp zero to the wall clock time the
+	// trace was created at
+	tr := RoundTrip(t, trace)
+	var realtime uint64
+	for _, c := range tr.Packet[0].GetClockSnapshot().GetClocks() {
+		if c.GetClockId() == uint32(pp.BuiltinClock_BUILTIN_CLOCK_REALTIME) {
+			realtime = c.GetTimestamp()
+		}
+	}
+	AssertEq("REALTIME", t, realtime, uint64(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).UnixNano()))
+
+	td := ReadBack(t, trace)
+	var got []uint64
+	for _, e := range td.Events {
+		got = append(got, e.Timestamp)
+	}
+	AssertEq("Events", t, len(got), 7)
+	for i, exp := range []uint64{100, 150, 200, 300, 400, 500, 0} {
+		AssertEq("Timestamp", t, got[i], exp)
+	}
+	AssertEq("Value", t, td.Events[5].Value, int64(7))
+}
+
+// The system clock is monotonic
+func TestSystemClock(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	end := trace.Begin(t1, "work")
+	time.Sleep(time.Millisecond)
+	end.End()
+
+	td := ReadBack(t, trace)
+	if d := td.Events[1].Timestamp - td.Events[0].Timestamp; d < uint64(time.Millisecond) {
+		t.Errorf("slice lasted %v, expected at least 1ms", time.Duration(d))
+	}
+}
+
+// Events on other clock domains keep their timestamps, and the
+// snapshots relate the domains to the trace clock
+func TestClockDomains(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	mono, device := uint64(5000), uint64(70)
+	feat := DefaultFeatures
+	feat.Clock = clock
+	feat.Clocks = []ClockDomain{
+		{ID: ClockMonotonic, Read: func() uint64 { return mono }},
+		{ID: 128, Read: func() uint64 { return device }, UnitMultiplierNs: 1000},
+	}
+	feat.SnapshotInterval = 1000
+	trace := NewTrace(feat)
+	t1 := trace.AddTrack("track #1")
+
+	trace.InstantEvent(t1, 100, "trace clock")
+	trace.With(OnClock(128)).InstantEvent(t1, 72, "device clock")
+	err := trace.With(OnClock(ClockMonotonicRaw)).AddEvent(NewEvent(t1, pp.TrackEvent_TYPE_INSTANT, 0, "raw", nil))
+	if !errors.Is(err, ErrUnknownClock) {
+		t.Errorf("For %s\ngot %v\nexp %v", "unknown clock", err, ErrUnknownClock)
+	}
+	if err := trace.With(OnClock(200)).InstantEvent(t1, 0, "unknown"); !errors.Is(err, ErrUnknownClock) {
+		t.Errorf("For %s\ngot %v\nexp %v", "InstantEvent", err, ErrUnknownClock)
+	}
+
+	// The first event after the interval takes a new snapshot
+	clock.Advance(2000)
+	mono, device = mono+2000, device+2
+	trace.InstantEvent(t1, 2000, "later")
+
+	var snaps []map[uint32]*pp.ClockSnapshot_Clock
+	for _, p := range RoundTrip(t, trace).Packet {
+		if cs := p.GetClockSnapshot(); cs != nil {
+			m := make(map[uint32]*pp.ClockSnapshot_Clock)
+			for _, c := range cs.GetClocks() {
+				m[c.GetClockId()] = c
+			}
+			snaps = append(snaps, m)
+		}
+	}
+	AssertEq("Snapshots", t, len(snaps), 3)
+	for id, exp := range map[ClockID]uint64{
+		ClockBoottime:  2000,
+		ClockRealtime:  uint64(start.UnixNano()) + 2000,
+		ClockMonotonic: 7000,
+		128:            72,
+	} {
+		AssertEq("Snapshot", t, snaps[2][uint32(id)].GetTimestamp(), exp)
+	}
+	AssertEq("Multiplier", t, snaps[1][128].GetUnitMultiplierNs(), uint64(1000))
+
+	td := ReadBack(t, trace)
+	AssertEq("Events", t, len(td.Events), 3)
+	AssertEvent(t, td.Events[0], Event{
+		Timestamp: 100, Name: "trace clock", Type: pp.TrackEvent_TYPE_INSTANT, TrackUuid: t1.Uuid,
+	})
+	AssertEvent(t, td.Events[1], Event{
+		Timestamp: 72, Clock: 128, Name: "device clock", Type: pp.TrackEvent_TYPE_INSTANT, TrackUuid: t1.Uuid,
+	})
+}
+
+// Events on other clocks are not reordered by SortEvents
+func TestSortEventsClocks(t *testing.T) {
+	feat := DefaultFeatures
+	feat.SortEvents = true
+	feat.Clocks = []ClockDomain{{ID: 128, Read: func() uint64 { return 0 }}}
+	trace := NewTrace(feat)
+	t1 := trace.AddTrack("track #1")
+	trace.InstantEvent(t1, 300, "c")
+	trace.With(OnClock(128)).InstantEvent(t1, 5, "device")
+	trace.InstantEvent(t1, 100, "a")
+
+	var got []string
+	for _, e := range ReadBack(t, trace).Events {
+		got = append(got, e.Name)
+	}
+	if exp := []string{"a", "device", "c"}; !slices.Equal(got, exp) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Events", got, exp)
+	}
+}
+
+// AnchorBoottime anchors the trace to the system BOOTTIME
+func TestAnchorBoottime(t *testing.T) {
+	for _, clocks := range [][]ClockDomain{nil, {{ID: ClockBoottime}}} {
+		feat := DefaultFeatures
+		feat.Clocks = clocks
+		feat.AnchorBoottime = true
+		trace := NewTrace(feat)
+		t1 := trace.AddTrack("track #1")
+		trace.InstantEvent(t1, 100, "instant")
+
+		cs := RoundTrip(t, trace).Packet[1].GetClockSnapshot()
+		AssertEq("Clocks", t, len(cs.GetClocks()), 2)
+		AssertNeq("BOOTTIME", t, cs.GetClocks()[0].GetTimestamp(), 0)
+		AssertNeq("Timestamp", t, ReadBack(t, trace).Events[0].Timestamp, 100)
+	}
+}
+
+// Builtin domains without a Read function are read from the system
+func TestSystemClockDomains(t *testing.T) {
+	feat := DefaultFeatures
+	feat.Clocks = []ClockDomain{{ID: ClockMonotonic}, {ID: ClockRealtime}}
+	trace := NewTrace(feat)
+
+	tr := RoundTrip(t, trace)
+	cs := tr.Packet[1].GetClockSnapshot()
+	AssertEq("Clocks", t, len(cs.GetClocks()), 3)
+	for _, c := range cs.GetClocks()[1:] {
+		AssertNeq("Timestamp", t, c.GetTimestamp(), 0)
+	}
+}
+
+// Traces anchored to a (recorded) boottime place their events at the
+// boottime they happened at
+func TestBoottimeAnchor(t *testing.T) {
+	const boottime = 86_400_000_000_000 // a day after boot
+	for _, feat := range []Features{DefaultFeatures, {Interning: true}, {IncrementalTS: true, SortEvents: true}} {
+		clock := &fakeClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+		feat.Clock = clock
+		feat.Clocks = []ClockDomain{{ID: ClockBoottime, Read: func() uint64 {
+			return boottime + uint64(clock.now.Sub(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)))
+		}}}
+		trace := NewTrace(feat)
+		t1 := trace.AddTrack("track #1")
+
+		clock.Advance(100)
+		trace.Instant(t1, "now")
+		trace.InstantEvent(t1, 50, "in the past")
+		trace.With(OnClock(ClockBoottime)).InstantEvent(t1, boottime+200, "on boottime")
+
+		tr := RoundTrip(t, trace)
+		cs := tr.Packet[0].GetClockSnapshot()
+		if feat.IncrementalTS {
+			AssertEq("BOOTTIME", t, cs.GetClocks()[0].GetTimestamp(), uint64(boottime))
+		}
+		td := ReadBack(t, trace)
+		var got []uint64
+		for _, e := range td.Events {
+			got = append(got, e.Timestamp)
+		}
+		exp := []uint64{boottime + 100, boottime + 50, boottime + 200}
+		if feat.SortEvents {
+			exp = []uint64{boottime + 50, boottime + 100, boottime + 200}
+		}
+		if !slices.Equal(got, exp) {
+			t.Errorf("For %s\ngot %v\nexp %v", "Timestamps", got, exp)
+		}
+	}
+}
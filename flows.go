@@ -0,0 +1,53 @@
+package perfetto
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+)
+
+// -- { Flows } --------------------------------
+
+// A Flow links causally related events, like a request being sent
+// and being handled, possibly on different tracks. Events are added
+// to a flow with the options returned by Step and Terminate.
+type Flow struct {
+	Id uint64
+}
+
+// nextFlowId holds the id of the last flow created by NewFlow. It's
+// shared by all the traces of the process, so that the flows of traces
+// that are later merged don't collide, and it starts from a random
+// value to make collisions with the flows of other processes unlikely.
+var nextFlowId atomic.Uint64
+
+func init() {
+	nextFlowId.Store(rand.Uint64())
+}
+
+// NewFlow returns a new Flow, with an id that's unique among the flows
+// created by the process.
+func (t *Trace) NewFlow() Flow {
+	for {
+		if id := nextFlowId.Add(1); id != 0 {
+			return Flow{Id: id}
+		}
+	}
+}
+
+// Step returns an EventOption that adds an event to the flow. It can
+// be used with any kind of event.
+func (f Flow) Step() EventOption {
+	return func(e *Event) {
+		e.Flows = slices.Concat(e.Flows, []uint64{f.Id})
+	}
+}
+
+// Terminate returns an EventOption that makes an event the last step
+// of the flow. Flows that are never terminated stay open until the end
+// of the trace in the UI.
+func (f Flow) Terminate() EventOption {
+	return func(e *Event) {
+		e.TerminatingFlows = slices.Concat(e.TerminatingFlows, []uint64{f.Id})
+	}
+}
@@ -0,0 +1,60 @@
+package perfetto
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFlowSteps(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	t2 := trace.AddTrack("track #2")
+
+	f := trace.NewFlow()
+	trace.With(f.Step()).StartSlice(t1, 100, "send")
+	trace.EndSlice(t1, 150)
+	trace.With(f.Step()).InstantEvent(t2, 200, "enqueue")
+	trace.With(f.Terminate()).StartSlice(t2, 300, "handle")
+	trace.EndSlice(t2, 400)
+
+	td := ReadBack(t, trace)
+	AssertEq("Events", t, len(td.Events), 5)
+	for i, exp := range [][2][]uint64{
+		{{f.Id}, nil}, {nil, nil}, {{f.Id}, nil}, {nil, {f.Id}}, {nil, nil},
+	} {
+		e := td.Events[i]
+		if !slices.Equal(e.Flows, exp[0]) || !slices.Equal(e.TerminatingFlows, exp[1]) {
+			t.Errorf("For %s\ngot %v %v\nexp %v %v", e.Name, e.Flows, e.TerminatingFlows, exp[0], exp[1])
+		}
+	}
+}
+
+// Options don't modify the flows passed to NewEvent
+func TestFlowStepsAliasing(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	flows := make([]uint64, 1, 2)
+	flows[0] = 1
+
+	f1, f2 := trace.NewFlow(), trace.NewFlow()
+	trace.With(f1.Step()).StartSliceWithFlow(t1, 100, "a", flows)
+	trace.With(f2.Step()).StartSliceWithFlow(t1, 200, "b", flows)
+
+	td := ReadBack(t, trace)
+	AssertEq("Flows", t, td.Events[0].Flows[1], f1.Id)
+	AssertEq("Flows", t, td.Events[1].Flows[1], f2.Id)
+}
+
+// Flow ids are unique across traces
+func TestFlowIds(t *testing.T) {
+	seen := make(map[uint64]bool)
+	for _, trace := range []Trace{NewTrace(), NewTrace()} {
+		for range 100 {
+			f := trace.NewFlow()
+			if f.Id == 0 || seen[f.Id] {
+				t.Fatalf("duplicate flow id %v", f.Id)
+			}
+			seen[f.Id] = true
+		}
+	}
+}
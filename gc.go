@@ -0,0 +1,120 @@
+package perfetto
+
+import (
+	"cmp"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// -- { GC pauses } --------------------------------
+
+// A GCCollector periodically reads runtime.MemStats, and adds a slice
+// for every GC pause to a "Go GC" track. MemStats records the sum of
+// the stop-the-world pauses of each GC cycle and the time the last
+// one ended, so the slice of a cycle ends with its last pause and
+// lasts the sum of its pauses. The runtime only keeps the pauses of
+// the last 256 cycles, so the ones of older cycles are lost if more
+// GCs happen between two polls.
+//
+// Slices have the pause duration, in nanoseconds, and the cycle number
+// as annotations. MemStats only describes the heap at the time it's
+// read, so the heap size before a cycle is not known: the slice of the
+// first cycle after a poll has the heap goal the cycle was started
+// for instead, which is a target and not a measure. The slice of the
+// last cycle before a poll has the live heap the cycle marked.
+type GCCollector struct {
+	trace    Trace // sequence of the collector
+	track    BasicTrack
+	interval time.Duration
+	read     func(*runtime.MemStats) uint64 // reads the stats and the live heap
+
+	mu       sync.Mutex // protects the fields below, during a Collect
+	numGC    uint32     // GC cycles already collected
+	heapGoal uint64     // heap goal of cycle numGC+1
+
+	poller poller
+}
+
+// NewGCCollector returns a collector of the GC pauses, and adds its
+// "Go GC" track to the trace, under the process p (usually the one
+// returned by AddCurrentProcess). Only the pauses of the GC cycles
+// that end after the collector is created are collected. The collector
+// adds events on its own sequence, and polls every interval, or every
+// second if interval is zero.
+func (t *Trace) NewGCCollector(p Process, interval time.Duration) *GCCollector {
+	return t.newGCCollector(p, interval, readMemStats)
+}
+
+func (t *Trace) newGCCollector(p Process, interval time.Duration, read func(*runtime.MemStats) uint64) *GCCollector {
+	c := &GCCollector{
+		trace:    t.NewSequence(),
+		track:    t.AddTrack("Go GC", Parent(p)),
+		interval: cmp.Or(interval, time.Second),
+		read:     read,
+	}
+	var ms runtime.MemStats
+	c.read(&ms)
+	c.numGC, c.heapGoal = ms.NumGC, ms.NextGC
+	return c
+}
+
+// readMemStats reads the memory stats, and returns the live heap.
+func readMemStats(ms *runtime.MemStats) uint64 {
+	runtime.ReadMemStats(ms)
+	live := []metrics.Sample{{Name: "/gc/heap/live:bytes"}}
+	metrics.Read(live)
+	if live[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return live[0].Value.Uint64()
+}
+
+// Track returns the track the GC pauses are added to.
+func (c *GCCollector) Track() BasicTrack {
+	return c.track
+}
+
+// Collect adds the pauses of the GC cycles that ended since the last
+// call to the trace.
+func (c *GCCollector) Collect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ms runtime.MemStats
+	live := c.read(&ms)
+
+	first := c.numGC
+	if ms.NumGC-first > uint32(len(ms.PauseNs)) {
+		first = ms.NumGC - uint32(len(ms.PauseNs))
+	}
+	for n := first; n < ms.NumGC; n++ {
+		// cycle n+1 is recorded at n%256
+		end := ms.PauseEnd[n%uint32(len(ms.PauseEnd))]
+		pause := ms.PauseNs[n%uint32(len(ms.PauseNs))]
+		ann := Annotations{{"pause", pause}, {"cycle", n + 1}}
+		if n == c.numGC {
+			ann = append(ann, KV{"heap goal", c.heapGoal})
+		}
+		if n == ms.NumGC-1 {
+			ann = append(ann, KV{"heap after", live})
+		}
+		c.trace.StartSlice(c.track, c.trace.Timestamp(time.Unix(0, int64(end-pause))), "GC pause", ann)
+		c.trace.EndSlice(c.track, c.trace.Timestamp(time.Unix(0, int64(end))))
+	}
+	c.numGC, c.heapGoal = ms.NumGC, ms.NextGC
+}
+
+// Start starts collecting the GC pauses every interval, on a new
+// goroutine, until Stop is called. Calling Start on a running
+// collector does nothing.
+func (c *GCCollector) Start() {
+	c.poller.start(c.interval, c.Collect)
+}
+
+// Stop stops the collector, and collects the pauses of the cycles that
+// ended since the last poll. The collector can be started again.
+func (c *GCCollector) Stop() {
+	c.poller.stop()
+	c.Collect()
+}
@@ -0,0 +1,75 @@
+package perfetto
+
+import (
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+)
+
+// Pauses are reconstructed from recorded MemStats
+func TestGCCollector(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	feat := DefaultFeatures
+	feat.Clock = &fakeClock{now: start}
+	trace := NewTrace(feat)
+	p := trace.AddProcess(1, "process #1")
+
+	ms := runtime.MemStats{NumGC: 3, NextGC: 4 << 20}
+	var live uint64
+	c := trace.newGCCollector(p, 0, func(m *runtime.MemStats) uint64 {
+		*m = ms
+		return live
+	})
+	pauseEnd := func(ts uint64) uint64 { return uint64(start.UnixNano()) + ts }
+	ms.PauseEnd[3], ms.PauseNs[3] = pauseEnd(1000), 100
+	ms.PauseEnd[4], ms.PauseNs[4] = pauseEnd(3000), 200
+	ms.NumGC, ms.NextGC, live = 5, 8<<20, 3<<20
+	c.Collect()
+	c.Collect()
+
+	td := ReadBack(t, trace)
+	AssertEq("Track parent", t, td.Tracks[0].ParentUuid, p.Uuid)
+	AssertEq("Events", t, len(td.Events), 4)
+	for i, ts := range []uint64{900, 1000, 2800, 3000} {
+		AssertEq("Timestamp", t, td.Events[i].Timestamp, ts)
+		AssertEq("Track", t, td.Events[i].TrackUuid, c.Track().Uuid)
+	}
+	AssertEq("Name", t, td.Events[0].Name, "GC pause")
+	AssertEq("Type", t, td.Events[1].Type, pp.TrackEvent_TYPE_SLICE_END)
+	for i, exp := range map[int]Annotations{
+		0: {{"pause", uint64(100)}, {"cycle", uint64(4)}, {"heap goal", uint64(4 << 20)}},
+		2: {{"pause", uint64(200)}, {"cycle", uint64(5)}, {"heap after", uint64(3 << 20)}},
+	} {
+		if got := td.Events[i].Ann; !slices.Equal(got, exp) {
+			t.Errorf("For %s\ngot %v\nexp %v", "Annotations", got, exp)
+		}
+	}
+
+	// Only the pauses of the last 256 cycles are known
+	ms.NumGC += 300
+	c.Collect()
+	AssertEq("Events", t, len(ReadBack(t, trace).Events), 4+2*256)
+}
+
+func TestGCCollectorRuntime(t *testing.T) {
+	trace := NewTrace()
+	p := trace.AddCurrentProcess("me")
+	c := trace.NewGCCollector(p, time.Hour)
+	c.Start()
+	runtime.GC()
+	runtime.GC()
+	c.Stop()
+
+	td := ReadBack(t, trace)
+	if len(td.Events) < 4 {
+		t.Fatalf("For %s\ngot %v\nexp >= 4", "Events", len(td.Events))
+	}
+	for i := 0; i < len(td.Events); i += 2 {
+		if td.Events[i+1].Timestamp < td.Events[i].Timestamp {
+			t.Errorf("pause %v ends before it begins", td.Events[i])
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package perfetto
+
+import (
+	"google.golang.org/protobuf/proto"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+)
+
+// -- { Log Messages } --------------------------------
+
+// Priority is the priority of a log message.
+type Priority int32
+
+const (
+	PrioUnspecified Priority = 0
+	PrioVerbose     Priority = 2
+	PrioDebug       Priority = 3
+	PrioInfo        Priority = 4
+	PrioWarn        Priority = 5
+	PrioError       Priority = 6
+	PrioFatal       Priority = 7
+)
+
+// LogMessage is a log message attached to an event. The UI shows log
+// messages in the logs panel, in addition to the timeline.
+type LogMessage struct {
+	Priority Priority
+	Body     string
+}
+
+// Log adds a log message to the track, as an instant event named
+// "LogMessage". If the SourceLocations feature is enabled, the caller
+// of Log is recorded as the source location of the message. It
+// returns an error if the message can't be added.
+func (t *Trace) Log(track Track, ts uint64, prio Priority, msg string, ann ...Annotations) error {
+	e := NewEvent(track, pp.TrackEvent_TYPE_INSTANT, ts, "LogMessage", nil, ann...)
+	e.Log = &LogMessage{Priority: prio, Body: msg}
+	return t.addCaller(e)
+}
+
+// emit returns the LogMessage proto. The body and the source location
+// of log messages can only be interned, so they are interned even if
+// the Interning feature is disabled.
+func (lm LogMessage) emit(s *sequence, loc SourceLocation) *pp.LogMessage {
+	m := &pp.LogMessage{
+		BodyIid: proto.Uint64(s.logBodyIid(lm.Body)),
+		Prio:    pp.LogMessage_Priority(lm.Priority).Enum(),
+	}
+	if loc != (SourceLocation{}) {
+		m.SourceLocationIid = proto.Uint64(s.sourceLocationIid(loc))
+	}
+	return m
+}
+
+// logBodyIid returns the iid of the log message body, interning it if
+// needed.
+func (s *sequence) logBodyIid(body string) uint64 {
+	iid, ok := intern(s.interning.LogMessageBodies, &s.interning.NextLogMessageBodyId, body)
+	if ok {
+		d := s.internedData()
+		d.LogMessageBody = append(d.LogMessageBody,
+			&pp.LogMessageBody{Iid: proto.Uint64(iid), Body: proto.String(body)})
+	}
+	return iid
+}
@@ -0,0 +1,40 @@
+package perfetto
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	for _, feat := range []Features{
+		{Interning: true, IncrementalTS: true, SourceLocations: true},
+		{SourceLocations: true},
+	} {
+		trace := NewTrace(feat)
+		t1 := trace.AddTrack("track #1")
+		_, file, line, _ := runtime.Caller(0)
+		trace.Log(t1, 100, PrioInfo, "starting", Annotations{{K: "workers", V: 4}})
+		trace.Log(t1, 200, PrioError, "failed")
+		trace.Log(t1, 300, PrioInfo, "starting")
+
+		tr := RoundTrip(t, trace)
+		p := tr.Packet[len(tr.Packet)-3]
+		AssertEq("bodies", t, len(p.GetInternedData().GetLogMessageBody()), 1)
+		AssertNeq("SequenceFlags", t, p.GetSequenceFlags(), 0)
+		AssertEq("location", t, p.GetTrackEvent().GetSourceLocationField(), nil)
+
+		td := ReadBack(t, trace)
+		AssertEq("Events", t, len(td.Events), 3)
+		for i, exp := range []LogMessage{
+			{Priority: PrioInfo, Body: "starting"},
+			{Priority: PrioError, Body: "failed"},
+			{Priority: PrioInfo, Body: "starting"},
+		} {
+			e := td.Events[i]
+			AssertEq("Log", t, *e.Log, exp)
+			AssertEq("File", t, e.Location.File, file)
+			AssertEq("Line", t, e.Location.Line, uint32(line+1+i))
+		}
+		AssertEq("Ann", t, td.Events[0].Ann[0], KV{K: "workers", V: int64(4)})
+	}
+}
@@ -0,0 +1,279 @@
+package perfetto
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime/metrics"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -- { Runtime metrics } --------------------------------
+
+// DefaultMetrics are the runtime/metrics sampled by a MetricsSampler
+// if MetricsOptions.Metrics is nil: heap size, goroutines, GC cycles,
+// scheduling latencies and the CPU time spent by class.
+var DefaultMetrics = []string{
+	"/memory/classes/heap/objects:bytes",
+	"/sched/goroutines:goroutines",
+	"/gc/cycles/total:gc-cycles",
+	"/sched/latencies:seconds",
+	"/cpu/classes/user:cpu-seconds",
+	"/cpu/classes/gc/total:cpu-seconds",
+	"/cpu/classes/scavenge/total:cpu-seconds",
+	"/cpu/classes/idle:cpu-seconds",
+}
+
+// DefaultPercentiles are the percentiles histogram metrics are reduced
+// to if MetricsOptions.Percentiles is nil.
+var DefaultPercentiles = []float64{50, 90, 99}
+
+// MetricsOptions configures a MetricsSampler.
+type MetricsOptions struct {
+	Interval    time.Duration // Time between samples. If 0, a second
+	Metrics     []string      // Names of the runtime/metrics to sample. If nil, DefaultMetrics
+	Percentiles []float64     // Percentiles of the histogram metrics. If nil, DefaultPercentiles
+	Parent      Track         // Optional parent of the counter tracks, like the current process
+}
+
+// A MetricsSampler periodically reads metrics from runtime/metrics,
+// and adds their values to counter tracks of a trace, one for each
+// metric. Histogram metrics have a counter for each percentile.
+// Metrics in seconds are emitted in nanoseconds, and cumulative
+// metrics on incremental counters. The percentiles of cumulative
+// histograms, like the scheduling latencies, are the ones of the
+// values recorded since the previous sample.
+type MetricsSampler struct {
+	trace    Trace // sequence of the sampler
+	interval time.Duration
+
+	mu      sync.Mutex // protects the fields below, during a Sample
+	samples []metrics.Sample
+	tracks  []metricTracks // by sample
+
+	poller poller
+}
+
+// metricTracks are the counter tracks of a metric.
+type metricTracks struct {
+	counters    []Counter // one, or one per percentile for histograms
+	percentiles []float64
+	scale       float64  // if not zero, float values are scaled to int ones
+	cumulative  bool     // whether the metric is a cumulative histogram
+	prev        []uint64 // bucket counts of the previous sample, for cumulative histograms
+}
+
+// NewMetricsSampler returns a sampler of the Go runtime metrics, and
+// adds their counter tracks to the trace. It returns an error if one
+// of the metrics is not supported by the runtime. The sampler adds
+// events on its own sequence, timestamped by the clock of the trace.
+func (t *Trace) NewMetricsSampler(opts MetricsOptions) (*MetricsSampler, error) {
+	names := opts.Metrics
+	if names == nil {
+		names = DefaultMetrics
+	}
+	percentiles := opts.Percentiles
+	if percentiles == nil {
+		percentiles = DefaultPercentiles
+	}
+	descs := make(map[string]metrics.Description)
+	for _, d := range metrics.All() {
+		descs[d.Name] = d
+	}
+
+	for _, name := range names {
+		if _, ok := descs[name]; !ok {
+			return nil, fmt.Errorf("unknown runtime metric %q", name)
+		}
+	}
+
+	m := &MetricsSampler{trace: t.NewSequence(), interval: opts.Interval}
+	if m.interval == 0 {
+		m.interval = time.Second
+	}
+	for _, name := range names {
+		m.samples = append(m.samples, metrics.Sample{Name: name})
+		m.tracks = append(m.tracks, t.addMetricTracks(descs[name], percentiles, opts.Parent))
+	}
+	return m, nil
+}
+
+// addMetricTracks adds the counter tracks of the metric to the trace.
+// Tracks are named after the metric, without the unit.
+func (t *Trace) addMetricTracks(d metrics.Description, percentiles []float64, parent Track) metricTracks {
+	name, unit, _ := strings.Cut(d.Name, ":")
+	var opts []CounterOption
+	if parent != nil {
+		opts = append(opts, CounterTrack(Parent(parent)))
+	}
+	var mt metricTracks
+	switch unit {
+	case "bytes":
+		opts = append(opts, BuiltinUnit(UnitSizeBytes))
+		if d.Kind != metrics.KindUint64 {
+			mt.scale = 1
+		}
+	case "seconds", "cpu-seconds":
+		opts = append(opts, BuiltinUnit(UnitTimeNs))
+		mt.scale = float64(time.Second)
+	default:
+		opts = append(opts, BuiltinUnit(UnitCount))
+		if d.Kind != metrics.KindUint64 {
+			opts = append(opts, FloatValues())
+		}
+	}
+
+	if d.Kind != metrics.KindFloat64Histogram {
+		if d.Cumulative {
+			opts = append(opts, Incremental())
+		}
+		mt.counters = []Counter{t.AddCounter(name, "", opts...)}
+		return mt
+	}
+	opts = append(opts, YAxisShareKey(name))
+	mt.percentiles = percentiles
+	mt.cumulative = d.Cumulative
+	for _, p := range percentiles {
+		pname := fmt.Sprintf("%s p%s", name, strconv.FormatFloat(p, 'f', -1, 64))
+		mt.counters = append(mt.counters, t.AddCounter(pname, "", opts...))
+	}
+	return mt
+}
+
+// Sample reads the metrics once, and adds their values to the trace.
+// It returns the errors of the values that couldn't be added.
+func (m *MetricsSampler) Sample() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metrics.Read(m.samples)
+	ts := m.trace.Now()
+	var errs []error
+	for i, s := range m.samples {
+		mt := &m.tracks[i]
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			errs = append(errs, m.trace.NewValue(mt.counters[0], ts, int64(s.Value.Uint64())))
+		case metrics.KindFloat64:
+			errs = append(errs, mt.add(&m.trace, mt.counters[0], ts, s.Value.Float64()))
+		case metrics.KindFloat64Histogram:
+			h := s.Value.Float64Histogram()
+			if mt.cumulative {
+				h = mt.delta(h)
+			}
+			for j, p := range mt.percentiles {
+				errs = append(errs, mt.add(&m.trace, mt.counters[j], ts, percentile(h, p)))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// add adds a float value to the counter, scaled to an int value if
+// needed.
+func (mt *metricTracks) add(t *Trace, c Counter, ts uint64, v float64) error {
+	if mt.scale != 0 {
+		return t.NewValue(c, ts, int64(v*mt.scale))
+	}
+	return t.NewFloatValue(c, ts, v)
+}
+
+// delta returns the histogram of the values recorded since the
+// previous call, and saves the counts of h for the next one.
+func (mt *metricTracks) delta(h *metrics.Float64Histogram) *metrics.Float64Histogram {
+	d := &metrics.Float64Histogram{Counts: slices.Clone(h.Counts), Buckets: h.Buckets}
+	if len(mt.prev) == len(h.Counts) {
+		for i, c := range mt.prev {
+			d.Counts[i] -= min(c, d.Counts[i])
+		}
+	}
+	mt.prev = append(mt.prev[:0], h.Counts...)
+	return d
+}
+
+// percentile returns the p-th percentile of the values in h, as the
+// upper bound of the bucket it falls in (or the lower bound, for the
+// last bucket when it's unbounded).
+func percentile(h *metrics.Float64Histogram, p float64) float64 {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(total)))
+	var seen uint64
+	for i, c := range h.Counts {
+		seen += c
+		if seen >= max(rank, 1) {
+			if math.IsInf(h.Buckets[i+1], 1) {
+				return h.Buckets[i]
+			}
+			return h.Buckets[i+1]
+		}
+	}
+	return h.Buckets[len(h.Buckets)-1]
+}
+
+// Start starts sampling the metrics every interval, on a new
+// goroutine, until Stop is called. The first sample is taken
+// immediately. Calling Start on a running sampler does nothing. The
+// errors of the samples taken in the background are dropped.
+func (m *MetricsSampler) Start() {
+	m.poller.start(m.interval, func() { m.Sample() })
+}
+
+// Stop stops the sampler, and waits for the sample being taken, if
+// any. The sampler can be started again.
+func (m *MetricsSampler) Stop() {
+	m.poller.stop()
+}
+
+// poller calls a function periodically, on its own goroutine.
+type poller struct {
+	mu   sync.Mutex    // protects the fields below, during start and stop
+	quit chan struct{} // closed to stop the goroutine
+	done chan struct{} // closed when the goroutine returns
+}
+
+// start calls f now and then every interval, until stop is called. It
+// does nothing if the poller is running.
+func (p *poller) start(interval time.Duration, f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.quit != nil {
+		return
+	}
+	quit, done := make(chan struct{}), make(chan struct{})
+	p.quit, p.done = quit, done
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		f()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-tick.C:
+				f()
+			}
+		}
+	}()
+}
+
+// stop stops the poller, and waits for the running call of f, if any.
+func (p *poller) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.quit == nil {
+		return
+	}
+	close(p.quit)
+	<-p.done
+	p.quit, p.done = nil, nil
+}
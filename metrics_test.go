@@ -0,0 +1,130 @@
+package perfetto
+
+import (
+	"math"
+	"runtime/metrics"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsSampler(t *testing.T) {
+	trace := NewTrace()
+	p := trace.AddProcess(1, "process #1")
+	m, err := trace.NewMetricsSampler(MetricsOptions{Parent: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := m.Sample(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	td := ReadBack(t, trace)
+	tracks := len(DefaultMetrics) - 1 + len(DefaultPercentiles)
+	AssertEq("Counters", t, len(td.Counters), tracks)
+	AssertEq("Events", t, len(td.Events), 2*tracks)
+
+	counters := make(map[string]Counter)
+	for _, c := range td.Counters {
+		AssertEq("Parent", t, c.ParentUuid, p.Uuid)
+		counters[c.Name] = c
+	}
+	for name, unit := range map[string]Unit{
+		"/memory/classes/heap/objects": UnitSizeBytes,
+		"/sched/goroutines":            UnitCount,
+		"/sched/latencies p99":         UnitTimeNs,
+		"/cpu/classes/user":            UnitTimeNs,
+	} {
+		AssertEq("Unit of "+name, t, counters[name].BuiltinUnit, unit)
+	}
+	AssertEq("Cumulative", t, counters["/gc/cycles/total"].IsIncremental, true)
+	AssertEq("Cumulative", t, counters["/sched/latencies p50"].IsIncremental, false)
+	AssertEq("Y axis", t, counters["/sched/latencies p50"].YAxisShareKey, "/sched/latencies")
+
+	for _, e := range td.Events {
+		if e.TrackUuid == counters["/sched/goroutines"].Uuid && e.Value < 1 {
+			t.Errorf("For %s\ngot %v\nexp > 0", "goroutines", e.Value)
+		}
+	}
+}
+
+// Histograms in bytes are emitted on int counters
+func TestMetricsSamplerBytesHistogram(t *testing.T) {
+	trace := NewTrace()
+	m, err := trace.NewMetricsSampler(MetricsOptions{Metrics: []string{"/gc/heap/allocs-by-size:bytes"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Sample(); err != nil {
+		t.Fatal(err)
+	}
+
+	td := ReadBack(t, trace)
+	AssertEq("Counters", t, len(td.Counters), len(DefaultPercentiles))
+	AssertEq("Events", t, len(td.Events), len(DefaultPercentiles))
+	AssertEq("Unit", t, td.Counters[0].BuiltinUnit, UnitSizeBytes)
+}
+
+func TestMetricsSamplerErrors(t *testing.T) {
+	trace := NewTrace()
+	_, err := trace.NewMetricsSampler(MetricsOptions{Metrics: []string{"/no/such:metric"}})
+	if err == nil || !strings.Contains(err.Error(), "/no/such:metric") {
+		t.Errorf("expected an error for an unknown metric, got %v", err)
+	}
+
+	// No tracks are added for a sampler that fails
+	AssertEq("Tracks", t, len(trace.Tracks()), 0)
+}
+
+func TestMetricsSamplerStartStop(t *testing.T) {
+	trace := NewTrace()
+	m, err := trace.NewMetricsSampler(MetricsOptions{
+		Interval: time.Millisecond,
+		Metrics:  []string{"/sched/goroutines:goroutines"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		m.Start()
+		m.Start()
+		time.Sleep(10 * time.Millisecond)
+		m.Stop()
+		m.Stop()
+	}
+	n := len(ReadBack(t, trace).Events)
+	if n < 2 {
+		t.Errorf("For %s\ngot %v\nexp >= 2", "samples", n)
+	}
+
+	// A stopped sampler doesn't add events
+	time.Sleep(10 * time.Millisecond)
+	AssertEq("Events", t, len(ReadBack(t, trace).Events), n)
+}
+
+func TestPercentile(t *testing.T) {
+	h := &metrics.Float64Histogram{
+		Counts:  []uint64{5, 0, 4, 1},
+		Buckets: []float64{math.Inf(-1), 1, 2, 3, math.Inf(1)},
+	}
+	for p, exp := range map[float64]float64{0: 1, 50: 1, 51: 3, 90: 3, 99: 3, 100: 3} {
+		AssertEq("Percentile", t, percentile(h, p), exp)
+	}
+	AssertEq("Empty", t, percentile(&metrics.Float64Histogram{
+		Counts: []uint64{0}, Buckets: []float64{0, 1},
+	}, 50), 0)
+}
+
+// Percentiles of cumulative histograms are the ones of the last period
+func TestHistogramDelta(t *testing.T) {
+	buckets := []float64{0, 1, 2, 3}
+	var mt metricTracks
+	d := mt.delta(&metrics.Float64Histogram{Counts: []uint64{100, 0, 0}, Buckets: buckets})
+	AssertEq("Percentile", t, percentile(d, 99), 1)
+	d = mt.delta(&metrics.Float64Histogram{Counts: []uint64{100, 0, 10}, Buckets: buckets})
+	AssertEq("Percentile", t, percentile(d, 50), 3)
+	d = mt.delta(&metrics.Float64Histogram{Counts: []uint64{100, 0, 10}, Buckets: buckets})
+	AssertEq("Percentile", t, percentile(d, 50), 0)
+}
@@ -1,14 +1,25 @@
 package perfetto
 
 import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
 	"math/rand/v2"
-
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 
 	pp "github.com/ALTree/perfetto/internal/proto"
 )
 
-// Common Trusted Packet Sequence ID
+// Trusted Packet Sequence ID of the default sequence of a trace
 const TPSID = 1
 
 // Clock ID for incremental timestamps
@@ -25,8 +36,66 @@ type Track interface {
 // BasicTrack represents a basic perfetto track. Process, Thread, and
 // Counter all embed BasicTrack.
 type BasicTrack struct {
-	Name string
-	Uuid uint64
+	Name       string
+	Uuid       uint64
+	ParentUuid uint64 // Uuid of the parent track, if any
+
+	Description      string   // optional description, shown in the UI
+	StaticName       bool     // whether Name is the same for all the instances of the track
+	ChildOrdering    Ordering // how the UI sorts the children of the track
+	SiblingOrderRank int32    // rank among siblings, for parents with OrderExplicit
+	DisallowMerging  bool     // keep the track apart from the system tracks of the same process or thread
+}
+
+// Ordering is the order used by the UI to sort the children of a
+// track.
+type Ordering int32
+
+const (
+	OrderDefault       Ordering = iota // let the UI decide
+	OrderLexicographic                 // sort by name
+	OrderChronological                 // sort by the timestamp of the first event
+	OrderExplicit                      // sort by SiblingOrderRank
+)
+
+// A TrackOption sets optional fields of a track.
+type TrackOption func(*BasicTrack)
+
+// Parent makes the track a child of parent, which can be any track,
+// including a Process or a Thread.
+func Parent(parent Track) TrackOption {
+	return func(t *BasicTrack) { t.ParentUuid = parent.GetUuid() }
+}
+
+// Description sets the description of the track.
+func Description(d string) TrackOption {
+	return func(t *BasicTrack) { t.Description = d }
+}
+
+// StaticName marks the name of the track as static, i.e. the same for
+// all the instances of the track. Dynamic names (the default) are
+// used for tracks named after runtime data.
+func StaticName() TrackOption {
+	return func(t *BasicTrack) { t.StaticName = true }
+}
+
+// ChildOrdering sets how the UI sorts the children of the track.
+func ChildOrdering(o Ordering) TrackOption {
+	return func(t *BasicTrack) { t.ChildOrdering = o }
+}
+
+// SiblingOrderRank sets the rank of the track among its siblings. It's
+// used when the parent track has OrderExplicit ordering: tracks with
+// lower ranks come first.
+func SiblingOrderRank(r int32) TrackOption {
+	return func(t *BasicTrack) { t.SiblingOrderRank = r }
+}
+
+// DisallowMerging prevents the UI from merging the track with the
+// tracks of a system trace that have the same pid or tid, when the
+// two traces are loaded together.
+func DisallowMerging() TrackOption {
+	return func(t *BasicTrack) { t.DisallowMerging = true }
 }
 
 func (t BasicTrack) GetName() string {
@@ -37,20 +106,45 @@ func (t BasicTrack) GetUuid() uint64 {
 	return t.Uuid
 }
 
-func NewTrack(name string) BasicTrack {
-	return BasicTrack{
+func NewTrack(name string, opts ...TrackOption) BasicTrack {
+	t := BasicTrack{
 		Name: name,
 		Uuid: rand.Uint64(),
 	}
+	for _, opt := range opts {
+		opt(&t)
+	}
+	return t
 }
 
 func (t BasicTrack) Emit() *pp.TracePacket_TrackDescriptor {
-	return &pp.TracePacket_TrackDescriptor{
+	td := &pp.TracePacket_TrackDescriptor{
 		&pp.TrackDescriptor{
-			Uuid:                &t.Uuid,
-			StaticOrDynamicName: &pp.TrackDescriptor_Name{Name: t.Name},
+			Uuid: &t.Uuid,
 		},
 	}
+	desc := td.TrackDescriptor
+	if t.StaticName {
+		desc.StaticOrDynamicName = &pp.TrackDescriptor_StaticName{StaticName: t.Name}
+	} else {
+		desc.StaticOrDynamicName = &pp.TrackDescriptor_Name{Name: t.Name}
+	}
+	if t.ParentUuid != 0 {
+		desc.ParentUuid = &t.ParentUuid
+	}
+	if t.Description != "" {
+		desc.Description = &t.Description
+	}
+	if t.ChildOrdering != OrderDefault {
+		desc.ChildOrdering = pp.TrackDescriptor_ChildTracksOrdering(t.ChildOrdering).Enum()
+	}
+	if t.SiblingOrderRank != 0 {
+		desc.SiblingOrderRank = &t.SiblingOrderRank
+	}
+	if t.DisallowMerging {
+		desc.DisallowMergingWithSystemTracks = proto.Bool(true)
+	}
+	return td
 }
 
 // The global track
@@ -64,53 +158,69 @@ func GlobalTrack() BasicTrack {
 type Process struct {
 	BasicTrack
 	Pid int32 // process id
+
+	Cmdline        []string // optional command line
+	StartTimestamp uint64   // optional start time, on the BOOTTIME clock
+	Labels         []string // optional labels describing the work of the process
+	Priority       int32    // optional priority
 }
 
-func NewProcess(pid int32, name string) Process {
+func NewProcess(pid int32, name string, opts ...TrackOption) Process {
 	return Process{
-		BasicTrack: NewTrack(name),
+		BasicTrack: NewTrack(name, opts...),
 		Pid:        pid,
 	}
 }
 
 func (p Process) Emit() *pp.TracePacket_TrackDescriptor {
-	return &pp.TracePacket_TrackDescriptor{
-		&pp.TrackDescriptor{
-			Uuid: &p.Uuid,
-			Process: &pp.ProcessDescriptor{
-				Pid:         &p.Pid,
-				ProcessName: &p.Name,
-			}},
+	td := p.BasicTrack.Emit()
+	desc := td.TrackDescriptor
+	desc.StaticOrDynamicName = nil // the name is in the process descriptor
+	desc.Process = &pp.ProcessDescriptor{
+		Pid:           &p.Pid,
+		ProcessName:   &p.Name,
+		Cmdline:       p.Cmdline,
+		ProcessLabels: p.Labels,
 	}
+	if p.StartTimestamp != 0 {
+		desc.Process.StartTimestampNs = proto.Int64(int64(p.StartTimestamp))
+	}
+	if p.Priority != 0 {
+		desc.Process.ProcessPriority = &p.Priority
+	}
+	return td
 }
 
 // -- { Thread } --------------------------------
 
-// Thread represents a perfetto track of kind 'thread'
+// Thread represents a perfetto track of kind 'thread'. Only the pid,
+// tid and name of the ThreadDescriptor are supported: its other fields
+// (chrome_thread_type, reference_timestamp_us and the like) are legacy
+// fields used by Chrome, with no effect on other traces.
 type Thread struct {
 	BasicTrack
 	Pid int32 // Parent process id
 	Tid int32 // Thread id
 }
 
-func NewThread(pid, tid int32, name string) Thread {
+func NewThread(pid, tid int32, name string, opts ...TrackOption) Thread {
 	return Thread{
-		BasicTrack: NewTrack(name),
+		BasicTrack: NewTrack(name, opts...),
 		Pid:        pid,
 		Tid:        tid,
 	}
 }
 
 func (t Thread) Emit() *pp.TracePacket_TrackDescriptor {
-	return &pp.TracePacket_TrackDescriptor{
-		&pp.TrackDescriptor{
-			Uuid: &t.Uuid,
-			Thread: &pp.ThreadDescriptor{
-				Pid:        &t.Pid,
-				Tid:        &t.Tid,
-				ThreadName: &t.Name,
-			}},
+	td := t.BasicTrack.Emit()
+	desc := td.TrackDescriptor
+	desc.StaticOrDynamicName = nil // the name is in the thread descriptor
+	desc.Thread = &pp.ThreadDescriptor{
+		Pid:        &t.Pid,
+		Tid:        &t.Tid,
+		ThreadName: &t.Name,
 	}
+	return td
 }
 
 // -- { Counter } --------------------------------
@@ -118,26 +228,132 @@ func (t Thread) Emit() *pp.TracePacket_TrackDescriptor {
 // Counter represents a perfetto track of kind 'Counter'
 type Counter struct {
 	BasicTrack
-	Unit string
+	Unit string // free-form unit name
+
+	BuiltinUnit    Unit        // unit known by the UI, used if Unit is empty
+	UnitMultiplier int64       // the values are multiplied by this, if not zero
+	IsIncremental  bool        // whether values are emitted as deltas
+	YAxisShareKey  string      // counters with the same key share the y-axis in the UI
+	Categories     []string    // optional categories
+	Type           CounterType // builtin counter type, if any
+	IsFloat        bool        // whether values are float64 instead of int64
 }
 
-func NewCounter(name, unit string) Counter {
-	return Counter{
+// ErrCounterKind is returned when adding a float value to an integer
+// counter, or an integer value to a float counter.
+var ErrCounterKind = errors.New("value kind doesn't match the counter")
+
+// Unit is a unit of measure known by perfetto.
+type Unit int32
+
+const (
+	UnitUnspecified Unit = iota
+	UnitTimeNs           // nanoseconds
+	UnitCount            // a count of things
+	UnitSizeBytes        // size in bytes
+)
+
+// CounterType is the type of a counter builtin in perfetto.
+type CounterType int32
+
+const (
+	CounterUnspecified            CounterType = iota
+	CounterThreadTimeNs                       // CPU time of a thread, in ns
+	CounterThreadInstructionCount             // instructions executed by a thread
+)
+
+// A CounterOption sets optional fields of a Counter.
+type CounterOption func(*Counter)
+
+// BuiltinUnit sets the unit of the counter to one of the units known
+// by perfetto.
+func BuiltinUnit(u Unit) CounterOption {
+	return func(c *Counter) { c.BuiltinUnit = u }
+}
+
+// UnitMultiplier sets a factor the counter values are multiplied by
+// when they are displayed, like 1024 for a counter in KiB.
+func UnitMultiplier(m int64) CounterOption {
+	return func(c *Counter) { c.UnitMultiplier = m }
+}
+
+// Incremental makes the counter incremental: values are still passed
+// to NewValue as absolute values, but they are emitted as deltas from
+// the previous value on the same sequence, which takes less space for
+// slowly growing counters.
+func Incremental() CounterOption {
+	return func(c *Counter) { c.IsIncremental = true }
+}
+
+// YAxisShareKey makes the UI use the same y-axis range for all the
+// counters with the same key.
+func YAxisShareKey(key string) CounterOption {
+	return func(c *Counter) { c.YAxisShareKey = key }
+}
+
+// CounterCategories sets the categories of the counter.
+func CounterCategories(cats ...string) CounterOption {
+	return func(c *Counter) { c.Categories = slices.Concat(c.Categories, cats) }
+}
+
+// FloatValues makes the counter hold float64 values, added with
+// NewFloatValue, instead of int64 ones.
+func FloatValues() CounterOption {
+	return func(c *Counter) { c.IsFloat = true }
+}
+
+// BuiltinCounter makes the counter one of the counters builtin in
+// perfetto, whose unit is known to the UI.
+func BuiltinCounter(t CounterType) CounterOption {
+	return func(c *Counter) { c.Type = t }
+}
+
+// CounterTrack applies track options, like Parent or Description, to
+// the track of the counter.
+func CounterTrack(opts ...TrackOption) CounterOption {
+	return func(c *Counter) {
+		for _, opt := range opts {
+			opt(&c.BasicTrack)
+		}
+	}
+}
+
+func NewCounter(name, unit string, opts ...CounterOption) Counter {
+	c := Counter{
 		BasicTrack: NewTrack(name),
 		Unit:       unit,
 	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
 }
 
 func (c Counter) Emit() *pp.TracePacket_TrackDescriptor {
-	return &pp.TracePacket_TrackDescriptor{
-		&pp.TrackDescriptor{
-			Uuid:                &c.Uuid,
-			StaticOrDynamicName: &pp.TrackDescriptor_Name{c.Name},
-			Counter: &pp.CounterDescriptor{
-				UnitName: proto.String(c.Unit),
-			},
-		},
+	td := c.BasicTrack.Emit()
+	cd := &pp.CounterDescriptor{
+		Categories: c.Categories,
+	}
+	if c.Unit != "" {
+		cd.UnitName = proto.String(c.Unit)
+	}
+	if c.BuiltinUnit != UnitUnspecified {
+		cd.Unit = pp.CounterDescriptor_Unit(c.BuiltinUnit).Enum()
+	}
+	if c.UnitMultiplier != 0 {
+		cd.UnitMultiplier = proto.Int64(c.UnitMultiplier)
 	}
+	if c.IsIncremental {
+		cd.IsIncremental = proto.Bool(true)
+	}
+	if c.YAxisShareKey != "" {
+		cd.YAxisShareKey = proto.String(c.YAxisShareKey)
+	}
+	if c.Type != CounterUnspecified {
+		cd.Type = pp.CounterDescriptor_BuiltinCounterType(c.Type).Enum()
+	}
+	td.TrackDescriptor.Counter = cd
+	return td
 }
 
 // -- { Event } --------------------------------
@@ -145,13 +361,92 @@ func (c Counter) Emit() *pp.TracePacket_TrackDescriptor {
 // Event is a perfetto Event
 type Event struct {
 	Timestamp uint64
+	Clock     ClockID // clock of Timestamp, if not the trace clock
 	Name      string
 	Type      pp.TrackEvent_Type
 	IsCounter bool        // true iff Even is a TrackEvent_Counter
 	Value     int64       // set for TrackEvent_Counters
+	IsFloat   bool        // true iff the counter value is FloatVal
+	FloatVal  float64     // set for TrackEvent_Counters with float values
 	TrackUuid uint64      // Uuid of the track this event is part of
 	Flows     []uint64    // optional flows IDs
 	Ann       Annotations // optional Debug Annotations
+
+	TerminatingFlows []uint64 // optional IDs of the flows ending with the event
+
+	CorrelationId    uint64 // optional ID grouping related events
+	CorrelationIdStr string // optional string ID grouping related events
+
+	Location  SourceLocation // optional source location
+	Log       *LogMessage    // optional log message
+	Callstack []Frame        // callstack, set by ReadTrace
+
+	Categories []string // optional categories
+
+	ExtraCounters []CounterSample // optional counter values sampled with the event
+
+	incremental bool      // Value is for an incremental counter
+	err         error     // set by options that can't be applied
+	pc          uintptr   // caller captured by the SourceLocations feature
+	stack       []uintptr // callstack captured by CaptureCallstacks
+}
+
+// A CounterSample is the value of a counter attached to an event of
+// another track, added with the ExtraCounter and ExtraFloatCounter
+// options.
+type CounterSample struct {
+	TrackUuid uint64  // Uuid of the counter track
+	IsFloat   bool    // true iff the value is FloatVal
+	Value     int64   // set for int counters
+	FloatVal  float64 // set for float counters
+
+	incremental bool // the counter is incremental
+}
+
+// An EventOption sets optional fields of an Event. Options are applied
+// to all the events added through a Trace handle returned by
+// Trace.With.
+type EventOption func(*Event)
+
+// ExtraCounter returns an EventOption that attaches a value of the
+// int counter c to an event, so that the counter is sampled exactly
+// when the event happens without emitting another packet. Events with
+// the option are rejected with ErrCounterKind if c is a float counter.
+func ExtraCounter(c Counter, val int64) EventOption {
+	return func(e *Event) {
+		if c.IsFloat {
+			e.err = fmt.Errorf("%w: int value on float counter %q", ErrCounterKind, c.Name)
+			return
+		}
+		e.ExtraCounters = append(e.ExtraCounters, CounterSample{
+			TrackUuid: c.Uuid, Value: val, incremental: c.IsIncremental,
+		})
+	}
+}
+
+// ExtraFloatCounter is like ExtraCounter, for float counters.
+func ExtraFloatCounter(c Counter, val float64) EventOption {
+	return func(e *Event) {
+		if !c.IsFloat {
+			e.err = fmt.Errorf("%w: float value on int counter %q", ErrCounterKind, c.Name)
+			return
+		}
+		e.ExtraCounters = append(e.ExtraCounters, CounterSample{
+			TrackUuid: c.Uuid, IsFloat: true, FloatVal: val, incremental: c.IsIncremental,
+		})
+	}
+}
+
+// Correlation returns an EventOption that sets the correlation id of
+// an event. The UI highlights together the events with the same
+// correlation id, like all the slices that handle the same request.
+func Correlation(id uint64) EventOption {
+	return func(e *Event) { e.CorrelationId = id }
+}
+
+// CorrelationStr is like Correlation, with a string id.
+func CorrelationStr(id string) EventOption {
+	return func(e *Event) { e.CorrelationIdStr = id }
 }
 
 func NewEvent(track Track, Type pp.TrackEvent_Type, ts uint64, name string, flows []uint64, ann ...Annotations) Event {
@@ -171,41 +466,127 @@ func NewEvent(track Track, Type pp.TrackEvent_Type, ts uint64, name string, flow
 func (e Event) Emit(tr *Trace) *pp.TracePacket_TrackEvent {
 	te := &pp.TracePacket_TrackEvent{
 		&pp.TrackEvent{
-			TrackUuid:        &e.TrackUuid,
-			Type:             &e.Type,
-			FlowIds:          e.Flows,
-			DebugAnnotations: e.Ann.Emit(tr),
+			Type:               &e.Type,
+			FlowIds:            e.Flows,
+			TerminatingFlowIds: e.TerminatingFlows,
+			DebugAnnotations:   e.Ann.Emit(tr),
 		},
 	}
 
-	if tr.features.Interning {
-		iid, _ := tr.interning.EventNames[e.Name]
-		te.TrackEvent.NameField = &pp.TrackEvent_NameIid{iid}
-	} else {
-		if e.Name != "" {
+	if tr.seq.track == 0 || e.TrackUuid != tr.seq.track {
+		te.TrackEvent.TrackUuid = proto.Uint64(e.TrackUuid)
+	}
+
+	if e.Name != "" {
+		if tr.features.Interning {
+			iid := tr.seq.eventNameIid(e.Name)
+			te.TrackEvent.NameField = &pp.TrackEvent_NameIid{iid}
+		} else {
 			te.TrackEvent.NameField = &pp.TrackEvent_Name{e.Name}
 		}
 	}
 
 	if e.IsCounter {
-		te.TrackEvent.CounterValueField = &pp.TrackEvent_CounterValue{e.Value}
+		if e.IsFloat {
+			te.TrackEvent.CounterValueField = &pp.TrackEvent_DoubleCounterValue{e.FloatVal}
+		} else {
+			te.TrackEvent.CounterValueField = &pp.TrackEvent_CounterValue{e.Value}
+		}
+	}
+
+	// Uuids of the extra counters are omitted when they match the
+	// defaults of the sequence
+	var ids, fids []uint64
+	for _, c := range e.ExtraCounters {
+		if c.IsFloat {
+			fids = append(fids, c.TrackUuid)
+			te.TrackEvent.ExtraDoubleCounterValues = append(te.TrackEvent.ExtraDoubleCounterValues, c.FloatVal)
+		} else {
+			ids = append(ids, c.TrackUuid)
+			te.TrackEvent.ExtraCounterValues = append(te.TrackEvent.ExtraCounterValues, c.Value)
+		}
+	}
+	if !isPrefix(ids, tr.seq.counterDefaults) {
+		te.TrackEvent.ExtraCounterTrackUuids = ids
+	}
+	if !isPrefix(fids, tr.seq.floatCounterDefaults) {
+		te.TrackEvent.ExtraDoubleCounterTrackUuids = fids
+	}
+
+	loc := e.Location
+	if loc == (SourceLocation{}) && e.pc != 0 {
+		loc = pcLocation(e.pc)
+	}
+	switch {
+	case e.Log != nil:
+		// the location is the one of the message
+		te.TrackEvent.LogMessage = e.Log.emit(tr.seq, loc)
+	case loc != (SourceLocation{}):
+		if tr.features.Interning {
+			iid := tr.seq.sourceLocationIid(loc)
+			te.TrackEvent.SourceLocationField = &pp.TrackEvent_SourceLocationIid{iid}
+		} else {
+			te.TrackEvent.SourceLocationField = &pp.TrackEvent_SourceLocation{loc.emit()}
+		}
+	}
+
+	// Callstacks are always interned; the event refers to its
+	// callstack through an annotation.
+	if e.stack != nil {
+		te.TrackEvent.DebugAnnotations = append(te.TrackEvent.DebugAnnotations,
+			tr.seq.callstackAnnotation(e.stack).Emit(tr)...)
+	}
+
+	switch {
+	case e.CorrelationIdStr != "" && tr.features.Interning:
+		iid := tr.seq.correlationIid(e.CorrelationIdStr)
+		te.TrackEvent.CorrelationIdField = &pp.TrackEvent_CorrelationIdStrIid{iid}
+	case e.CorrelationIdStr != "":
+		te.TrackEvent.CorrelationIdField = &pp.TrackEvent_CorrelationIdStr{e.CorrelationIdStr}
+	case e.CorrelationId != 0:
+		te.TrackEvent.CorrelationIdField = &pp.TrackEvent_CorrelationId{e.CorrelationId}
+	}
+
+	if tr.features.Interning {
+		for _, c := range e.Categories {
+			te.TrackEvent.CategoryIids = append(te.TrackEvent.CategoryIids, tr.seq.categoryIid(c))
+		}
+	} else {
+		te.TrackEvent.Categories = e.Categories
 	}
 
 	return te
 }
 
+// isPrefix reports whether ids is a prefix of defaults. Perfetto pairs
+// the values of the extra counters of an event with the default uuids
+// of the sequence, and there can be more uuids than values.
+func isPrefix(ids, defaults []uint64) bool {
+	return len(ids) <= len(defaults) && slices.Equal(ids, defaults[:len(ids)])
+}
+
 // -- { Clock Snapshot  } --------------------------------
 
 // Returns a packet that can be emitted on the track to enable incremental timestamps
 func EmitClockSnapshot() *pp.TracePacket {
+	return clockSnapshot(TPSID, 0, time.Time{})
+}
+
+// clockSnapshot returns a clock snapshot packet for the sequence with
+// the given id, that maps timestamp zero to boottime on the BOOTTIME
+// clock. The CustomClockID clock is sequence-scoped, so every sequence
+// needs its own snapshot. If epoch is not zero, the snapshot also maps
+// timestamp zero to it on the REALTIME clock, so that the UI can show
+// wall-clock times.
+func clockSnapshot(seqID uint32, boottime uint64, epoch time.Time) *pp.TracePacket {
 	boottimeClockId := uint32(pp.BuiltinClock_BUILTIN_CLOCK_BOOTTIME)
-	return &pp.TracePacket{
+	tp := &pp.TracePacket{
 		Data: &pp.TracePacket_ClockSnapshot{
 			&pp.ClockSnapshot{
 				Clocks: []*pp.ClockSnapshot_Clock{
 					{
 						ClockId:   &boottimeClockId,
-						Timestamp: proto.Uint64(0),
+						Timestamp: proto.Uint64(boottime),
 					},
 					{
 						ClockId:       proto.Uint32(CustomClockID),
@@ -215,26 +596,183 @@ func EmitClockSnapshot() *pp.TracePacket {
 				},
 			},
 		},
-		OptionalTrustedPacketSequenceId: &pp.TracePacket_TrustedPacketSequenceId{TPSID},
+		OptionalTrustedPacketSequenceId: &pp.TracePacket_TrustedPacketSequenceId{seqID},
 	}
-
+	if !epoch.IsZero() {
+		cs := tp.GetClockSnapshot()
+		cs.Clocks = append(cs.Clocks, &pp.ClockSnapshot_Clock{
+			ClockId:   proto.Uint32(uint32(pp.BuiltinClock_BUILTIN_CLOCK_REALTIME)),
+			Timestamp: proto.Uint64(uint64(epoch.UnixNano())),
+		})
+	}
+	return tp
 }
 
 // -- { Trace } --------------------------------
 
+// Trace is a handle to a perfetto trace. All the methods of Trace are
+// safe for concurrent use, but events added through the same handle
+// share a single packet sequence, so each producer goroutine should
+// get its own handle from NewSequence.
 type Trace struct {
-	Threads  map[int32]Thread   // Thread tracks added to the trace
-	Counters map[string]Counter // Counter tracks added to the trace
+	// Thread tracks added to the trace, by tid.
+	//
+	// Deprecated: threads of different processes with the same tid
+	// overwrite each other. Use Thread instead.
+	Threads map[int32]Thread
+
+	// Counter tracks added to the trace, by name.
+	//
+	// Deprecated: counters with the same name overwrite each other.
+	// Use TracksByName instead.
+	Counters map[string]Counter
+
+	features Features
+	st       *state        // state shared by all the handles to the trace
+	seq      *sequence     // packet sequence of this handle
+	opts     []EventOption // options applied to the events of this handle
+}
 
-	pt            pp.Trace
-	features      Features
+// state is the part of a Trace that is shared between all its
+// sequences. It's protected by mu.
+type state struct {
+	mu      sync.Mutex
+	pt      pp.Trace
+	w       io.Writer         // if not nil, packets are streamed to w instead of kept in pt
+	err     error             // first error encountered while writing to w
+	buf     []byte            // scratch buffer for packets written to w
+	tracks  []*pp.TracePacket // track descriptors, emitted again after a Reset
+	seqs    []*sequence       // all the sequences of the trace
+	nextSeq uint32            // id of the next sequence
+
+	clock      Clock           // source of time for Now
+	epoch      time.Time       // time of timestamp zero
+	boottime   uint64          // BOOTTIME of timestamp zero
+	clocks     []ClockDomain   // clock domains of the trace
+	nextSnap   uint64          // timestamp of the next periodic clock snapshot
+	categories categoryFilter  // enabled and disabled event categories
+	callstacks callstackConfig // events that get a callstack
+	open       sliceStacks     // open slices, by track
+	lanes      asyncLanes      // tracks used for async slices, by parent
+	reg        registry        // tracks added to the trace
+}
+
+// sequence is a perfetto trusted packet sequence. Interned data and
+// incremental timestamps are scoped to a sequence.
+type sequence struct {
+	id            uint32    // trusted_packet_sequence_id
 	interning     Interning // interning maps (used if features.Interning)
 	lastTimestamp uint64    // for incremental timestmaps (used if features.IncrementalTS)
+	cleared       bool      // whether SEQ_INCREMENTAL_STATE_CLEARED was emitted in this chunk
+
+	interned *pp.InternedData // data interned for the packet being built
+	pending  []pendingEvent   // events buffered by the SortEvents feature
+	counters map[uint64]int64 // last values of the incremental counters
+
+	fcounters map[uint64]float64 // last values of the incremental float counters
+
+	// The TracePacketDefaults of the sequence. They are emitted when
+	// the sequence starts, with the clock of the incremental
+	// timestamps and the default track, and again when the first
+	// event with extra counters sets the uuids of the counters.
+	hasDefaults          bool
+	track                uint64 // default track uuid, set by NewTrackSequence
+	countersSet          bool
+	counterDefaults      []uint64
+	floatCounterDefaults []uint64
+}
+
+// intern returns the iid of v in the interning map m, and whether v
+// was added to m by this call.
+func intern[K comparable](m map[K]uint64, next *uint64, v K) (uint64, bool) {
+	if iid, ok := m[v]; ok {
+		return iid, false
+	}
+	iid := *next
+	m[v] = iid
+	*next++
+	return iid, true
+}
+
+// internedData returns the interned data that will be emitted with
+// the packet being built.
+func (s *sequence) internedData() *pp.InternedData {
+	if s.interned == nil {
+		s.interned = &pp.InternedData{}
+	}
+	return s.interned
+}
+
+// eventNameIid returns the iid of the event name, interning it if
+// needed.
+func (s *sequence) eventNameIid(name string) uint64 {
+	iid, ok := intern(s.interning.EventNames, &s.interning.NextNameId, name)
+	if ok {
+		d := s.internedData()
+		d.EventNames = append(d.EventNames, &pp.EventName{Iid: proto.Uint64(iid), Name: proto.String(name)})
+	}
+	return iid
+}
+
+// categoryIid returns the iid of the event category, interning it if
+// needed.
+func (s *sequence) categoryIid(cat string) uint64 {
+	iid, ok := intern(s.interning.EventCategories, &s.interning.NextCategoryId, cat)
+	if ok {
+		d := s.internedData()
+		d.EventCategories = append(d.EventCategories,
+			&pp.EventCategory{Iid: proto.Uint64(iid), Name: proto.String(cat)})
+	}
+	return iid
+}
+
+// annNameIid returns the iid of the debug annotation name, interning
+// it if needed.
+func (s *sequence) annNameIid(name string) uint64 {
+	iid, ok := intern(s.interning.DebugAnnotationNames, &s.interning.NextAnnNameId, name)
+	if ok {
+		d := s.internedData()
+		d.DebugAnnotationNames = append(d.DebugAnnotationNames,
+			&pp.DebugAnnotationName{Iid: proto.Uint64(iid), Name: proto.String(name)})
+	}
+	return iid
+}
+
+// annValueIid returns the iid of the debug annotation string value,
+// interning it if needed.
+func (s *sequence) annValueIid(v string) uint64 {
+	iid, ok := intern(s.interning.AnnValues, &s.interning.NextAnnId, v)
+	if ok {
+		d := s.internedData()
+		d.DebugAnnotationStringValues = append(d.DebugAnnotationStringValues,
+			&pp.InternedString{Iid: proto.Uint64(iid), Str: []byte(v)})
+	}
+	return iid
+}
+
+// correlationIid returns the iid of the correlation id, interning it
+// if needed.
+func (s *sequence) correlationIid(id string) uint64 {
+	iid, ok := intern(s.interning.CorrelationIds, &s.interning.NextCorrelationId, id)
+	if ok {
+		d := s.internedData()
+		d.CorrelationIdStr = append(d.CorrelationIdStr,
+			&pp.InternedString{Iid: proto.Uint64(iid), Str: []byte(id)})
+	}
+	return iid
 }
 
 type Features struct {
-	Interning     bool // Use string interninng
-	IncrementalTS bool // Emit incremental timestamp
+	Interning       bool // Use string interninng
+	IncrementalTS   bool // Emit incremental timestamp
+	SortEvents      bool // Buffer events and emit them sorted by timestamp
+	SourceLocations bool // Record the caller of StartSlice, InstantEvent, etc.
+
+	Clock Clock // Source of time for Begin, Instant, etc. If nil, time.Now
+
+	Clocks           []ClockDomain // Clock domains events can be timestamped on
+	SnapshotInterval time.Duration // If not zero, snapshot the clock domains periodically
+	AnchorBoottime   bool          // Add the system BOOTTIME domain, if not in Clocks, to anchor the trace
 }
 
 var DefaultFeatures = Features{
@@ -243,22 +781,47 @@ var DefaultFeatures = Features{
 }
 
 type Interning struct {
-	EventNames map[string]uint64
-	NextNameId uint64
-	AnnValues  map[string]uint64
-	NextAnnId  uint64
+	EventNames           map[string]uint64
+	NextNameId           uint64
+	AnnValues            map[string]uint64
+	NextAnnId            uint64
+	DebugAnnotationNames map[string]uint64
+	NextAnnNameId        uint64
+	EventCategories      map[string]uint64
+	NextCategoryId       uint64
+	CorrelationIds       map[string]uint64
+	NextCorrelationId    uint64
+	SourceLocations      map[SourceLocation]uint64
+	NextSourceLocationId uint64
+	LogMessageBodies     map[string]uint64
+	NextLogMessageBodyId uint64
+	FunctionNames        map[string]uint64
+	NextFunctionNameId   uint64
+	Mappings             map[string]uint64
+	NextMappingId        uint64
+	Frames               map[Frame]uint64
+	NextFrameId          uint64
+	Callstacks           map[string]uint64
+	NextCallstackId      uint64
 }
 
 func NewTrace(features ...Features) Trace {
+	return newTrace(nil, features)
+}
+
+// NewStreamingTrace returns a trace that writes every packet to w as
+// soon as it is added, instead of buffering the whole trace in memory.
+// At any point, the data written to w is a valid perfetto trace.
+// Errors encountered while writing to w are reported by Flush.
+func NewStreamingTrace(w io.Writer, features ...Features) Trace {
+	return newTrace(w, features)
+}
+
+func newTrace(w io.Writer, features []Features) Trace {
 	tr := Trace{
 		Threads:  make(map[int32]Thread),
 		Counters: make(map[string]Counter),
-		interning: Interning{
-			EventNames: make(map[string]uint64),
-			NextNameId: 1,
-			AnnValues:  make(map[string]uint64),
-			NextAnnId:  1,
-		},
+		st:       &state{w: w, nextSeq: TPSID},
 	}
 
 	if len(features) > 0 {
@@ -266,190 +829,809 @@ func NewTrace(features ...Features) Trace {
 	} else {
 		tr.features = DefaultFeatures
 	}
-
-	if tr.features.IncrementalTS {
-		tr.pt.Packet = append(tr.pt.Packet, EmitClockSnapshot())
+	tr.st.clock = tr.features.Clock
+	if tr.st.clock == nil {
+		tr.st.clock = systemClock{}
+	}
+	tr.st.epoch = tr.st.clock.Now()
+	clocks := tr.features.Clocks
+	if tr.features.AnchorBoottime && !slices.ContainsFunc(clocks, func(d ClockDomain) bool { return d.ID == ClockBoottime }) {
+		clocks = append(slices.Clip(clocks), ClockDomain{ID: ClockBoottime})
 	}
+	tr.setClocks(clocks)
 
+	tr.seq = tr.newSequence(0)
+	if len(tr.st.clocks) > 0 {
+		tr.snapshotClocks()
+	}
 	return tr
 }
 
-// AddTrack adds a BasicTrack with the given name to the trace. It
-// returns a handle that can be used to associate events to the
-// track.
-func (t *Trace) AddTrack(name string) BasicTrack {
-	tr := NewTrack(name)
-	t.pt.Packet = append(t.pt.Packet, &pp.TracePacket{Data: tr.Emit()})
+// NewSequence returns a new handle to the trace. Events added through
+// the returned handle are emitted on a new packet sequence, with its
+// own interning tables and its own incremental clock. Handles can be
+// used concurrently: each goroutine adding events to the trace should
+// use its own sequence.
+func (t *Trace) NewSequence() Trace {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	seq := *t
+	seq.seq = t.newSequence(0)
+	return seq
+}
+
+// With returns a new handle to the trace that applies the given
+// options to every event added through it, after the options of t.
+// The returned handle emits events on the same sequence as t.
+func (t *Trace) With(opts ...EventOption) *Trace {
+	h := *t
+	h.opts = slices.Concat(t.opts, opts)
+	return &h
+}
+
+// NewTrackSequence is like NewSequence, for a sequence whose events
+// are mostly on the given track. The track is set as the default track
+// of the sequence, so that its events don't need to repeat the uuid.
+// Events on other tracks can still be added to the sequence.
+func (t *Trace) NewTrackSequence(track Track) Trace {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	seq := *t
+	seq.seq = t.newSequence(track.GetUuid())
+	return seq
+}
+
+func (t *Trace) newSequence(track uint64) *sequence {
+	s := &sequence{id: t.st.nextSeq, track: track}
+	t.st.nextSeq++
+	t.st.seqs = append(t.st.seqs, s)
+	t.start(s)
+	return s
+}
+
+// start resets the interning and incremental timestamps state of the
+// sequence, and emits the packets the sequence needs to begin with.
+func (t *Trace) start(s *sequence) {
+	s.interning = Interning{
+		EventNames: make(map[string]uint64),
+		NextNameId: 1,
+		AnnValues:  make(map[string]uint64),
+		NextAnnId:  1,
+
+		DebugAnnotationNames: make(map[string]uint64),
+		NextAnnNameId:        1,
+		EventCategories:      make(map[string]uint64),
+		NextCategoryId:       1,
+		CorrelationIds:       make(map[string]uint64),
+		NextCorrelationId:    1,
+		SourceLocations:      make(map[SourceLocation]uint64),
+		NextSourceLocationId: 1,
+		LogMessageBodies:     make(map[string]uint64),
+		NextLogMessageBodyId: 1,
+		FunctionNames:        make(map[string]uint64),
+		NextFunctionNameId:   1,
+		Mappings:             make(map[string]uint64),
+		NextMappingId:        1,
+		Frames:               make(map[Frame]uint64),
+		NextFrameId:          1,
+		Callstacks:           make(map[string]uint64),
+		NextCallstackId:      1,
+	}
+	s.lastTimestamp = 0
+	s.cleared = false
+	s.counters = make(map[uint64]int64)
+	s.fcounters = make(map[uint64]float64)
+	s.countersSet = false
+	s.counterDefaults, s.floatCounterDefaults = nil, nil
+
+	// The defaults are emitted on the clock snapshot packet, if there
+	// is one.
+	var tp *pp.TracePacket
+	if t.features.IncrementalTS {
+		epoch := t.st.epoch
+		if t.st.hasClock(ClockRealtime) {
+			epoch = time.Time{} // snapshotClocks reads the real one
+		}
+		tp = clockSnapshot(s.id, t.st.boottime, epoch)
+	}
+	s.hasDefaults = t.features.IncrementalTS || s.track != 0
+	if s.hasDefaults {
+		if tp == nil {
+			tp = &pp.TracePacket{OptionalTrustedPacketSequenceId: &pp.TracePacket_TrustedPacketSequenceId{s.id}}
+		}
+		tp.TracePacketDefaults = t.defaults(s)
+		s.setFlags(tp)
+	}
+	if tp != nil {
+		t.emit(tp)
+	}
+}
+
+// defaults returns the TracePacketDefaults of the sequence. Packets of
+// the sequence omit the fields that match the defaults.
+func (t *Trace) defaults(s *sequence) *pp.TracePacketDefaults {
+	d := &pp.TracePacketDefaults{}
+	if t.features.IncrementalTS {
+		d.TimestampClockId = proto.Uint32(CustomClockID)
+	}
+	if s.track != 0 || s.countersSet {
+		d.TrackEventDefaults = &pp.TrackEventDefaults{
+			ExtraCounterTrackUuids:       s.counterDefaults,
+			ExtraDoubleCounterTrackUuids: s.floatCounterDefaults,
+		}
+		if s.track != 0 {
+			d.TrackEventDefaults.TrackUuid = proto.Uint64(s.track)
+		}
+	}
+	return d
+}
+
+// emit adds the given packet to the trace. For streaming traces, the
+// packet is immediately written to the trace's io.Writer.
+func (t *Trace) emit(tp *pp.TracePacket) {
+	st := t.st
+	if st.w == nil {
+		st.pt.Packet = append(st.pt.Packet, tp)
+		return
+	}
+	if st.err != nil {
+		return
+	}
+
+	// Each packet is encoded as the 'packet' field (number 1) of the
+	// Trace message, so the concatenation of the writes is itself a
+	// valid Trace.
+	buf := protowire.AppendTag(st.buf[:0], 1, protowire.BytesType)
+	buf = protowire.AppendVarint(buf, uint64(proto.Size(tp)))
+	buf, st.err = proto.MarshalOptions{UseCachedSize: true}.MarshalAppend(buf, tp)
+	if st.err == nil {
+		_, st.err = st.w.Write(buf)
+	}
+	st.buf = buf
+}
+
+// emitTrack emits the descriptor of a track, and saves it so that it
+// can be emitted again at the start of a new chunk.
+func (t *Trace) emitTrack(td *pp.TracePacket_TrackDescriptor) {
+	tp := &pp.TracePacket{Data: td}
+	t.st.tracks = append(t.st.tracks, tp)
+	t.emit(tp)
+}
+
+// AddTrack adds a BasicTrack with the given name and options to the
+// trace. It returns a handle that can be used to associate events to
+// the track.
+func (t *Trace) AddTrack(name string, opts ...TrackOption) BasicTrack {
+	tr := NewTrack(name, opts...)
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	t.st.reg.reserve(&tr)
+	t.emitTrack(tr.Emit())
+	t.st.reg.add(tr)
 	return tr
 }
 
-// AddProcess adds a process with the given pid and name to the trace.
-// It returns a handle that can be used to associate events to the
-// process.
-func (t *Trace) AddProcess(pid int32, name string) Process {
-	pr := NewProcess(pid, name)
-	t.pt.Packet = append(t.pt.Packet, &pp.TracePacket{Data: pr.Emit()})
+// AddProcess adds a process with the given pid, name and options to
+// the trace. It returns a handle that can be used to associate events
+// to the process.
+func (t *Trace) AddProcess(pid int32, name string, opts ...TrackOption) Process {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	return t.addProcess(NewProcess(pid, name, opts...))
+}
+
+func (t *Trace) addProcess(pr Process) Process {
+	t.st.reg.reserve(&pr.BasicTrack)
+	t.emitTrack(pr.Emit())
+	t.st.reg.add(pr)
 	return pr
 }
 
-// AddThread adds a thread with the given tid and name to the trace,
-// under the process with the given pid. It returns a handle that can
-// be used to associate events to the thread.
-func (t *Trace) AddThread(pid, tid int32, name string) Thread {
-	tr := NewThread(pid, tid, name)
-	t.pt.Packet = append(t.pt.Packet, &pp.TracePacket{Data: tr.Emit()})
-	t.Threads[tid] = tr
+// AddThread adds a thread with the given tid, name and options to the
+// trace, under the process with the given pid. It returns a handle
+// that can be used to associate events to the thread.
+func (t *Trace) AddThread(pid, tid int32, name string, opts ...TrackOption) Thread {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	return t.addThread(NewThread(pid, tid, name, opts...))
+}
+
+func (t *Trace) addThread(tr Thread) Thread {
+	t.st.reg.reserve(&tr.BasicTrack)
+	t.emitTrack(tr.Emit())
+	t.st.reg.add(tr)
+	t.Threads[tr.Tid] = tr
 	return tr
 }
 
-// AddCounter adds a Counter track with the given name to the trace.
-// It returns a handle that can be used to associate events to the
-// track.
-func (t *Trace) AddCounter(name, unit string) Counter {
-	ct := NewCounter(name, unit)
-	t.pt.Packet = append(t.pt.Packet, &pp.TracePacket{Data: ct.Emit()})
+// AddCurrentProcess is like AddProcess, for the process calling it.
+// Its track is merged with the one of the same process in a system
+// trace loaded together with the trace, unless the DisallowMerging
+// option is given. The two traces only line up if the trace is
+// anchored, with Features.AnchorBoottime or a BOOTTIME clock domain.
+func (t *Trace) AddCurrentProcess(name string, opts ...TrackOption) Process {
+	return t.AddProcess(int32(os.Getpid()), name, opts...)
+}
+
+// AddCurrentThread is like AddThread, for the OS thread the calling
+// goroutine is running on. Goroutines move between threads, so it's
+// mostly useful after runtime.LockOSThread. As for AddCurrentProcess,
+// the trace must be anchored to line up with a system trace.
+func (t *Trace) AddCurrentThread(name string, opts ...TrackOption) Thread {
+	return t.AddThread(int32(os.Getpid()), gettid(), name, opts...)
+}
+
+// AddCounter adds a Counter track with the given name, unit and
+// options to the trace. It returns a handle that can be used to
+// associate events to the track.
+func (t *Trace) AddCounter(name, unit string, opts ...CounterOption) Counter {
+	ct := NewCounter(name, unit, opts...)
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	t.st.reg.reserve(&ct.BasicTrack)
+	t.emitTrack(ct.Emit())
+	t.st.reg.add(ct)
 	t.Counters[name] = ct
 	return ct
 }
 
-// AddEvent adds the given event to the trace.
-func (t *Trace) AddEvent(e Event) {
+// AddEvent adds the given event to the trace, after applying the
+// options of the handle. Events in disabled categories are dropped.
+// Slice end events that don't match a slice begin event on the same
+// track are not added, and AddEvent returns an error.
+func (t *Trace) AddEvent(e Event) error {
+	t.apply(&e)
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	return t.add(e)
+}
 
-	var internedData *pp.InternedData
+// addCaller is like AddEvent, for the exported methods that record
+// their caller in e.
+func (t *Trace) addCaller(e Event) error {
+	t.apply(&e)
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	if !t.st.categories.eventEnabled(e.Categories) {
+		return nil
+	}
+	t.setCaller(&e, 1)
+	return t.add(e)
+}
 
-	if t.features.Interning {
-		// Event Names Interning
-		if _, ok := t.interning.EventNames[e.Name]; !ok && e.Name != "" {
-			iid := t.interning.NextNameId
-			internedData = &pp.InternedData{
-				EventNames: []*pp.EventName{
-					&pp.EventName{Iid: &iid, Name: &e.Name},
-				},
+// apply applies the options of the handle to e.
+func (t *Trace) apply(e *Event) {
+	for _, opt := range t.opts {
+		opt(e)
+	}
+}
+
+// add adds e to the trace, if it's enabled and correctly nested.
+func (t *Trace) add(e Event) error {
+	if !t.st.categories.eventEnabled(e.Categories) {
+		return nil
+	}
+	if err := t.validate(e); err != nil {
+		return err
+	}
+	if err := t.st.open.check(e); err != nil {
+		return err
+	}
+	t.queue(e, rankAny, 0)
+	return nil
+}
+
+// validate returns the error of e, if it can't be added to the trace
+// on any track.
+func (t *Trace) validate(e Event) error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.Clock != 0 && !t.st.hasClock(e.Clock) {
+		return fmt.Errorf("%w (clock %v)", ErrUnknownClock, e.Clock)
+	}
+	return nil
+}
+
+// pendingEvent is an event buffered by the SortEvents feature.
+type pendingEvent struct {
+	e    Event
+	rank int    // orders events with the same timestamp
+	dur  uint64 // duration, for events added by Slice
+}
+
+// Ranks of events with the same timestamp. Slices added by Slice end
+// before other events at the same timestamp, and begin after them,
+// so that consecutive slices don't overlap. Zero-duration slices end
+// after they begin.
+const (
+	rankEnd = iota
+	rankAny
+	rankBegin
+	rankZeroEnd
+)
+
+// queue adds e to the trace, or buffers it if the SortEvents feature
+// is enabled.
+func (t *Trace) queue(e Event, rank int, dur uint64) {
+	if !t.features.SortEvents {
+		t.addEvent(e)
+		return
+	}
+	t.seq.pending = append(t.seq.pending, pendingEvent{e: e, rank: rank, dur: dur})
+}
+
+// flushPending adds the events buffered by all the sequences of the
+// trace, sorted by timestamp. Events with the same timestamp and rank
+// are added in the order they were buffered, except that slices added
+// by Slice are nested by duration. Events on other clocks than the
+// trace clock keep their position: only the events on the trace clock
+// are sorted, among the positions they were buffered at.
+func (t *Trace) flushPending() {
+	for _, s := range t.st.seqs {
+		var pos []int
+		var sorted []pendingEvent
+		for i, pe := range s.pending {
+			if pe.e.Clock == 0 {
+				pos = append(pos, i)
+				sorted = append(sorted, pe)
 			}
-			t.interning.EventNames[e.Name] = iid
-			t.interning.NextNameId++
+		}
+		slices.SortStableFunc(sorted, comparePending)
+		for j, i := range pos {
+			s.pending[i] = sorted[j]
 		}
 
-		// Debug Annotations Values Interning
-		var arr []*pp.InternedString
-		for _, ann := range e.Ann {
-			iid, ok := t.interning.AnnValues[ann.V]
-			if !ok && ann.V != "" {
-				iid = t.interning.NextAnnId
-				arr = append(arr, &pp.InternedString{Iid: &iid, Str: []byte(ann.V)})
-				t.interning.AnnValues[ann.V] = iid
-				t.interning.NextAnnId++
-			}
+		h := Trace{features: t.features, st: t.st, seq: s}
+		for _, pe := range s.pending {
+			h.addEvent(pe.e)
 		}
-		if len(arr) > 0 {
-			if internedData == nil {
-				internedData = &pp.InternedData{}
+		s.pending = nil
+	}
+}
+
+// comparePending orders events on the trace clock by timestamp, then
+// by rank.
+func comparePending(a, b pendingEvent) int {
+	if c := cmp.Compare(a.e.Timestamp, b.e.Timestamp); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.rank, b.rank); c != 0 {
+		return c
+	}
+	switch a.rank {
+	case rankEnd:
+		return cmp.Compare(a.dur, b.dur) // inner slices end first
+	case rankBegin:
+		return cmp.Compare(b.dur, a.dur) // outer slices begin first
+	}
+	return 0
+}
+
+func (t *Trace) addEvent(e Event) {
+	s := t.seq
+
+	// Values of incremental counters are emitted as deltas from the
+	// previous value emitted on the sequence.
+	switch {
+	case e.incremental && e.IsFloat:
+		e.FloatVal = s.floatDelta(e.TrackUuid, e.FloatVal)
+	case e.incremental:
+		e.Value = s.delta(e.TrackUuid, e.Value)
+	}
+	if slices.ContainsFunc(e.ExtraCounters, func(c CounterSample) bool { return c.incremental }) {
+		e.ExtraCounters = slices.Clone(e.ExtraCounters)
+		for i, c := range e.ExtraCounters {
+			switch {
+			case c.incremental && c.IsFloat:
+				e.ExtraCounters[i].FloatVal = s.floatDelta(c.TrackUuid, c.FloatVal)
+			case c.incremental:
+				e.ExtraCounters[i].Value = s.delta(c.TrackUuid, c.Value)
 			}
-			internedData.DebugAnnotationStringValues = arr
 		}
 	}
 
+	// The extra counters of the first event that has them become the
+	// defaults of the sequence, so that later events sampling the
+	// same counters don't need to repeat their uuids.
+	if len(e.ExtraCounters) > 0 && !s.countersSet {
+		t.emitCounterDefaults(e.ExtraCounters)
+	}
+
 	tp := &pp.TracePacket{
 		Data:                            e.Emit(t),
-		OptionalTrustedPacketSequenceId: &pp.TracePacket_TrustedPacketSequenceId{TPSID},
+		OptionalTrustedPacketSequenceId: &pp.TracePacket_TrustedPacketSequenceId{s.id},
 	}
 
 	// We emit an incremental timestamp if 1) the feature is enabled
 	// and 2) the delta since the last timestamp is positive. If (2)
 	// is not true, emit the event on the default, non-incremental
-	// clock to avoid a wraparound on the uint64 delta.
-	if t.features.IncrementalTS && e.Timestamp >= t.lastTimestamp {
-		delta := e.Timestamp - t.lastTimestamp
-		t.lastTimestamp = e.Timestamp
-		tp.Timestamp = &delta
-		tp.TimestampClockId = proto.Uint32(CustomClockID)
-	} else {
+	// clock to avoid a wraparound on the uint64 delta. Events on
+	// other clocks always have absolute timestamps.
+	switch {
+	case e.Clock != 0:
 		tp.Timestamp = &e.Timestamp
+		tp.TimestampClockId = proto.Uint32(uint32(e.Clock))
+	case t.features.IncrementalTS && e.Timestamp >= s.lastTimestamp:
+		delta := e.Timestamp - s.lastTimestamp
+		s.lastTimestamp = e.Timestamp
+		tp.Timestamp = &delta // on CustomClockID, the default clock
+	default:
+		ts := t.st.boottime + e.Timestamp
+		tp.Timestamp = &ts
+		if t.features.IncrementalTS {
+			tp.TimestampClockId = proto.Uint32(uint32(pp.BuiltinClock_BUILTIN_CLOCK_BOOTTIME))
+		}
 	}
 
-	// In addition to this Event's data, emit the interning data
-	if internedData != nil {
-		tp.InternedData = internedData
-		if len(t.interning.EventNames) == 1 {
-			// First packet with interning data needs to set these
-			tp.PreviousPacketDropped = proto.Bool(true)
-			tp.SequenceFlags = proto.Uint32(uint32(
-				pp.TracePacket_SEQ_INCREMENTAL_STATE_CLEARED |
-					pp.TracePacket_SEQ_NEEDS_INCREMENTAL_STATE))
-		}
-	} else {
-		// Later packets using interned data need to set this
-		if t.features.Interning {
-			tp.SequenceFlags = proto.Uint32(uint32(
+	// In addition to this Event's data, emit the data that was
+	// interned while building it
+	tp.InternedData = s.interned
+	s.interned = nil
+	if t.features.Interning || e.incremental || e.Log != nil || e.stack != nil || s.hasDefaults {
+		s.setFlags(tp)
+	}
+
+	t.emit(tp)
+
+	if e.Clock == 0 && t.features.SnapshotInterval > 0 && e.Timestamp >= t.st.nextSnap {
+		t.snapshotClocks()
+	}
+}
+
+// setFlags sets the sequence flags of tp, a packet that depends on the
+// incremental state of the sequence.
+func (s *sequence) setFlags(tp *pp.TracePacket) {
+	if !s.cleared {
+		// First packet of the chunk needs to set these
+		tp.PreviousPacketDropped = proto.Bool(true)
+		tp.SequenceFlags = proto.Uint32(uint32(
+			pp.TracePacket_SEQ_INCREMENTAL_STATE_CLEARED |
 				pp.TracePacket_SEQ_NEEDS_INCREMENTAL_STATE))
+		s.cleared = true
+	} else {
+		// Later packets using interned data (or incremental
+		// counters, or the defaults) need to set this
+		tp.SequenceFlags = proto.Uint32(uint32(
+			pp.TracePacket_SEQ_NEEDS_INCREMENTAL_STATE))
+	}
+}
+
+// delta returns the difference between v and the previous value of
+// the incremental counter with the given uuid, and records v.
+func (s *sequence) delta(uuid uint64, v int64) int64 {
+	prev := s.counters[uuid]
+	s.counters[uuid] = v
+	return v - prev
+}
+
+func (s *sequence) floatDelta(uuid uint64, v float64) float64 {
+	prev := s.fcounters[uuid]
+	s.fcounters[uuid] = v
+	return v - prev
+}
+
+// emitCounterDefaults emits a packet that adds the uuids of the given
+// extra counters to the TrackEventDefaults of the sequence.
+func (t *Trace) emitCounterDefaults(cs []CounterSample) {
+	s := t.seq
+	for _, c := range cs {
+		if c.IsFloat {
+			s.floatCounterDefaults = append(s.floatCounterDefaults, c.TrackUuid)
+		} else {
+			s.counterDefaults = append(s.counterDefaults, c.TrackUuid)
 		}
 	}
+	s.countersSet = true
+	s.hasDefaults = true
 
-	t.pt.Packet = append(t.pt.Packet, tp)
+	tp := &pp.TracePacket{
+		TracePacketDefaults:             t.defaults(s),
+		OptionalTrustedPacketSequenceId: &pp.TracePacket_TrustedPacketSequenceId{s.id},
+	}
+	s.setFlags(tp)
+	t.emit(tp)
 }
 
-func (t *Trace) InstantEvent(track Track, ts uint64, name string) {
-	t.AddEvent(NewEvent(track, pp.TrackEvent_TYPE_INSTANT, ts, name, nil))
+// InstantEvent adds an instant event to the track. It returns an error
+// if the event can't be added, like when it's on an unknown clock.
+func (t *Trace) InstantEvent(track Track, ts uint64, name string) error {
+	return t.addCaller(NewEvent(track, pp.TrackEvent_TYPE_INSTANT, ts, name, nil))
 }
 
-func (t *Trace) StartSlice(track Track, ts uint64, name string, ann ...Annotations) {
-	t.AddEvent(NewEvent(track, pp.TrackEvent_TYPE_SLICE_BEGIN, ts, name, nil, ann...))
+// StartSlice starts a slice on the track. It returns an error if the
+// slice can't be started, like when it's on an unknown clock.
+func (t *Trace) StartSlice(track Track, ts uint64, name string, ann ...Annotations) error {
+	return t.addCaller(NewEvent(track, pp.TrackEvent_TYPE_SLICE_BEGIN, ts, name, nil, ann...))
 }
 
-func (t *Trace) StartSliceWithFlow(track Track, ts uint64, name string, flows []uint64, ann ...Annotations) {
-	t.AddEvent(NewEvent(track, pp.TrackEvent_TYPE_SLICE_BEGIN, ts, name, flows, ann...))
+// Slice adds a complete slice, that begins at ts and lasts dur, to
+// the track. It returns an error if the slice can't be added, like
+// when it's on an unknown clock.
+func (t *Trace) Slice(track Track, ts, dur uint64, name string, ann ...Annotations) error {
+	begin := NewEvent(track, pp.TrackEvent_TYPE_SLICE_BEGIN, ts, name, nil, ann...)
+	end := NewEvent(track, pp.TrackEvent_TYPE_SLICE_END, ts+dur, "", nil)
+	t.apply(&begin)
+	t.apply(&end)
+
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	if !t.st.categories.eventEnabled(begin.Categories) {
+		return nil
+	}
+	if err := t.validate(begin); err != nil {
+		return err
+	}
+	t.setCaller(&begin, 0)
+	endRank := rankEnd
+	if dur == 0 {
+		endRank = rankZeroEnd
+	}
+	t.queue(begin, rankBegin, dur)
+	t.queue(end, endRank, dur)
+	return nil
 }
 
-func (t *Trace) EndSlice(track Track, ts uint64) {
-	t.AddEvent(NewEvent(track, pp.TrackEvent_TYPE_SLICE_END, ts, "", nil))
+func (t *Trace) StartSliceWithFlow(track Track, ts uint64, name string, flows []uint64, ann ...Annotations) error {
+	return t.addCaller(NewEvent(track, pp.TrackEvent_TYPE_SLICE_BEGIN, ts, name, flows, ann...))
 }
 
-func (t *Trace) EndSliceWithFlow(track Track, ts uint64, flows []uint64) {
-	t.AddEvent(NewEvent(track, pp.TrackEvent_TYPE_SLICE_END, ts, "", flows))
+// EndSlice ends the last slice started on the track. It returns an
+// error if there's no open slice on the track, or if the slice began
+// after ts.
+func (t *Trace) EndSlice(track Track, ts uint64) error {
+	return t.AddEvent(NewEvent(track, pp.TrackEvent_TYPE_SLICE_END, ts, "", nil))
 }
 
-func (t *Trace) NewValue(track Counter, ts uint64, val int64) {
-	t.AddEvent(Event{
-		Timestamp: ts,
-		Type:      pp.TrackEvent_TYPE_COUNTER,
-		Name:      track.Name,
-		Value:     val,
-		IsCounter: true,
-		TrackUuid: track.Uuid,
+func (t *Trace) EndSliceWithFlow(track Track, ts uint64, flows []uint64) error {
+	return t.AddEvent(NewEvent(track, pp.TrackEvent_TYPE_SLICE_END, ts, "", flows))
+}
+
+// NewValue adds a value to the counter track. For incremental
+// counters, val is the absolute value: the delta from the previous
+// value is computed when the event is emitted. It returns
+// ErrCounterKind if the counter holds float values.
+func (t *Trace) NewValue(track Counter, ts uint64, val int64) error {
+	if track.IsFloat {
+		return fmt.Errorf("%w: int value on float counter %q", ErrCounterKind, track.Name)
+	}
+	return t.AddEvent(Event{
+		Timestamp:   ts,
+		Type:        pp.TrackEvent_TYPE_COUNTER,
+		Name:        track.Name,
+		Value:       val,
+		IsCounter:   true,
+		TrackUuid:   track.Uuid,
+		incremental: track.IsIncremental,
+	})
+}
+
+// NewFloatValue adds a float value to the counter track, which must
+// have been created with the FloatValues option. It returns
+// ErrCounterKind otherwise.
+func (t *Trace) NewFloatValue(track Counter, ts uint64, val float64) error {
+	if !track.IsFloat {
+		return fmt.Errorf("%w: float value on int counter %q", ErrCounterKind, track.Name)
+	}
+	return t.AddEvent(Event{
+		Timestamp:   ts,
+		Type:        pp.TrackEvent_TYPE_COUNTER,
+		Name:        track.Name,
+		FloatVal:    val,
+		IsFloat:     true,
+		IsCounter:   true,
+		TrackUuid:   track.Uuid,
+		incremental: track.IsIncremental,
 	})
 }
 
+// Reset starts a new chunk of the trace, discarding the packets
+// buffered so far. Every chunk is self-contained: the clock snapshot
+// and the descriptors of the tracks added so far are emitted again,
+// and the interning and incremental timestamps state starts from
+// scratch, so that packets of the new chunk never refer to data that
+// was emitted in a previous one. For streaming traces, the new chunk
+// is written to the same io.Writer. Events buffered by the SortEvents
+// feature are added to the old chunk before it ends.
 func (t *Trace) Reset() {
-	t.pt = pp.Trace{}
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	t.flushPending()
+	t.st.pt = pp.Trace{}
+	for _, s := range t.st.seqs {
+		t.start(s)
+	}
+	for _, tp := range t.st.tracks {
+		t.emit(tp)
+	}
+	if len(t.st.clocks) > 0 {
+		t.snapshotClocks()
+	}
 }
 
-// Marshal calls proto.Marshal on the protobuf trace
+// Marshal calls proto.Marshal on the protobuf trace. For streaming
+// traces, packets are not buffered and Marshal returns an empty
+// trace. If the SortEvents feature is enabled, the events buffered so
+// far are added to the trace first.
 func (t Trace) Marshal() ([]byte, error) {
-	return proto.Marshal(&t.pt)
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	t.flushPending()
+	return proto.Marshal(&t.st.pt)
+}
+
+// Flush returns the first error encountered while writing a
+// streaming trace to its io.Writer. If the SortEvents feature is
+// enabled, the events buffered so far are written first. If the
+// io.Writer has a Flush method (like a bufio.Writer), Flush calls it.
+func (t *Trace) Flush() error {
+	st := t.st
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t.flushPending()
+	if st.err != nil {
+		return st.err
+	}
+	if f, ok := st.w.(interface{ Flush() error }); ok {
+		st.err = f.Flush()
+	}
+	return st.err
 }
 
 // -- { Misc } ----------------------------------------------------------------
 
-// KV is a (key, value) tuple representing a Debug Annotation
+// KV is a (key, value) tuple representing a Debug Annotation. The
+// value can be a string, a bool, an integer or floating point number,
+// a Pointer, a JSON document, nested Annotations, or a map, slice,
+// array or struct of those; errors and fmt.Stringers are emitted as
+// strings. Other values are formatted with fmt.Sprint.
 type KV struct {
-	K, V string
+	K string
+	V any
 }
 
+// Pointer is a Debug Annotation value that is displayed as a memory
+// address. It's 64 bits wide on all platforms, so that the pointers of
+// traces recorded on 64-bit platforms are read back unchanged.
+type Pointer uint64
+
+// JSON is a Debug Annotation value holding a JSON document.
+type JSON string
+
 type Annotations []KV
 
 func (a Annotations) Emit(tr *Trace) []*pp.DebugAnnotation {
-	iids := tr.interning.AnnValues
+	return a.emit(tr, 0)
+}
+
+// Nested values deeper than this are formatted with fmt.Sprint, to
+// avoid looping forever on cyclic data structures.
+const maxAnnotationDepth = 16
+
+// annotation returns an unnamed DebugAnnotation holding the value v.
+func (tr *Trace) annotation(v any, depth int) *pp.DebugAnnotation {
+	da := &pp.DebugAnnotation{}
+	if depth > maxAnnotationDepth {
+		tr.setString(da, fmt.Sprint(v))
+		return da
+	}
+
+	switch v := v.(type) {
+	case Pointer:
+		da.Value = &pp.DebugAnnotation_PointerValue{PointerValue: uint64(v)}
+		return da
+	case JSON:
+		da.Value = &pp.DebugAnnotation_LegacyJsonValue{LegacyJsonValue: string(v)}
+		return da
+	case Annotations:
+		da.DictEntries = v.emit(tr, depth+1)
+		return da
+	case []KV:
+		da.DictEntries = Annotations(v).emit(tr, depth+1)
+		return da
+	case error:
+		tr.setString(da, safeString(v, v.Error))
+		return da
+	case fmt.Stringer:
+		tr.setString(da, safeString(v, v.String))
+		return da
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		tr.setString(da, rv.String())
+	case reflect.Bool:
+		da.Value = &pp.DebugAnnotation_BoolValue{BoolValue: rv.Bool()}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		da.Value = &pp.DebugAnnotation_IntValue{IntValue: rv.Int()}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		da.Value = &pp.DebugAnnotation_UintValue{UintValue: rv.Uint()}
+	case reflect.Float32, reflect.Float64:
+		da.Value = &pp.DebugAnnotation_DoubleValue{DoubleValue: rv.Float()}
+	case reflect.UnsafePointer:
+		da.Value = &pp.DebugAnnotation_PointerValue{PointerValue: uint64(rv.Pointer())}
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			da.Value = &pp.DebugAnnotation_PointerValue{PointerValue: 0}
+		} else {
+			da = tr.annotation(rv.Elem().Interface(), depth+1)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range rv.Len() {
+			da.ArrayValues = append(da.ArrayValues, tr.annotation(rv.Index(i).Interface(), depth+1))
+		}
+	case reflect.Map:
+		// Sort the entries by key, so that the output is
+		// deterministic.
+		var ann Annotations
+		for it := rv.MapRange(); it.Next(); {
+			ann = append(ann, KV{K: fmt.Sprint(it.Key().Interface()), V: it.Value().Interface()})
+		}
+		slices.SortFunc(ann, func(a, b KV) int { return strings.Compare(a.K, b.K) })
+		da.DictEntries = ann.emit(tr, depth+1)
+	case reflect.Struct:
+		// Exported fields are emitted as dict entries, under the name
+		// given by a `perfetto:"name"` struct tag, if there's one.
+		// Fields tagged with `perfetto:"-"` are skipped.
+		var ann Annotations
+		for i := range rv.NumField() {
+			f := rv.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name := f.Name
+			if tag := f.Tag.Get("perfetto"); tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			ann = append(ann, KV{K: name, V: rv.Field(i).Interface()})
+		}
+		da.DictEntries = ann.emit(tr, depth+1)
+	default:
+		tr.setString(da, fmt.Sprint(v))
+	}
+
+	return da
+}
+
+// safeString returns the result of f, the Error or String method of
+// v. Like fmt, it returns "<nil>" if the method panics on a nil
+// pointer, so that typed nils can be used as annotation values.
+func safeString(v any, f func() string) (s string) {
+	defer func() {
+		if err := recover(); err != nil {
+			if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer && rv.IsNil() {
+				s = "<nil>"
+				return
+			}
+			s = fmt.Sprintf("%%!v(PANIC=%v)", err)
+		}
+	}()
+	return f()
+}
+
+func (a Annotations) emit(tr *Trace, depth int) []*pp.DebugAnnotation {
 	var res []*pp.DebugAnnotation
 	for i := range a {
-		name := &pp.DebugAnnotation_Name{Name: a[i].K}
+		da := tr.annotation(a[i].V, depth)
 		if tr.features.Interning {
-			iid, _ := iids[a[i].V]
-			value := &pp.DebugAnnotation_StringValueIid{StringValueIid: iid}
-			res = append(res, &pp.DebugAnnotation{NameField: name, Value: value})
+			da.NameField = &pp.DebugAnnotation_NameIid{NameIid: tr.seq.annNameIid(a[i].K)}
 		} else {
-			value := &pp.DebugAnnotation_StringValue{StringValue: a[i].V}
-			res = append(res, &pp.DebugAnnotation{NameField: name, Value: value})
+			da.NameField = &pp.DebugAnnotation_Name{Name: a[i].K}
 		}
+		res = append(res, da)
 	}
 	return res
 }
+
+// setString sets v as the string value of da, interning it if the
+// Interning feature is enabled.
+func (tr *Trace) setString(da *pp.DebugAnnotation, v string) {
+	if tr.features.Interning && v != "" {
+		da.Value = &pp.DebugAnnotation_StringValueIid{StringValueIid: tr.seq.annValueIid(v)}
+	} else {
+		da.Value = &pp.DebugAnnotation_StringValue{StringValue: v}
+	}
+}
@@ -1,8 +1,16 @@
 package perfetto
 
 import (
+	"bytes"
+	"cmp"
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
 	"slices"
+	"sync"
 	"testing"
 
 	pp "github.com/ALTree/perfetto/internal/proto"
@@ -19,6 +27,37 @@ func TestAddBasicTrack(t *testing.T) {
 	AssertEq("Name", t, BasicTrackName(tr.Packet[1]), "track #1")
 }
 
+// Adding a tree of tracks under a process
+func TestTrackHierarchy(t *testing.T) {
+	trace := NewTrace()
+	p := trace.AddProcess(1, "process #1")
+	svc := trace.AddTrack("Service", Parent(p), StaticName(),
+		Description("requests served"), ChildOrdering(OrderExplicit))
+	get := trace.AddTrack("GET /users", Parent(svc), SiblingOrderRank(2),
+		ChildOrdering(OrderChronological))
+	post := trace.AddTrack("POST /users", Parent(svc), SiblingOrderRank(1))
+	req := trace.AddTrack("Request 1", Parent(get))
+
+	tr := RoundTrip(t, trace)
+	AssertEq("trace length", t, len(tr.Packet), 6)
+	desc := tr.Packet[2].GetTrackDescriptor()
+	AssertEq("Static Name", t, desc.GetStaticName(), "Service")
+	AssertEq("Parent", t, desc.GetParentUuid(), p.Uuid)
+	AssertEq("Description", t, desc.GetDescription(), "requests served")
+	AssertEq("Child Ordering", t, desc.GetChildOrdering(), pp.TrackDescriptor_EXPLICIT)
+	desc = tr.Packet[3].GetTrackDescriptor()
+	AssertEq("Name", t, desc.GetName(), "GET /users")
+	AssertEq("Parent", t, desc.GetParentUuid(), svc.Uuid)
+	AssertEq("Sibling Order Rank", t, desc.GetSiblingOrderRank(), 2)
+	AssertEq("Child Ordering", t, desc.GetChildOrdering(), pp.TrackDescriptor_CHRONOLOGICAL)
+
+	td := ReadBack(t, trace)
+	exp := []BasicTrack{svc, get, post, req}
+	if !slices.Equal(td.Tracks, exp) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Tracks", td.Tracks, exp)
+	}
+}
+
 // Adding a single process to the trace
 func TestAddProcess(t *testing.T) {
 	trace := NewTrace()
@@ -50,6 +89,30 @@ func TestAddThread(t *testing.T) {
 	AssertEq("Thread #2 Pid", t, ThreadPid(t2), 1)
 }
 
+// The tracks of the current process and thread have their real ids,
+// and can opt out of being merged with the system tracks
+func TestAddCurrentProcess(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	trace := NewTrace()
+	p := trace.AddCurrentProcess("me", DisallowMerging())
+	th := trace.AddCurrentThread("main")
+	tr := RoundTrip(t, trace)
+
+	AssertEq("Pid", t, ProcessPid(tr.Packet[1]), int32(os.Getpid()))
+	AssertEq("Disallow merging", t, tr.Packet[1].GetTrackDescriptor().GetDisallowMergingWithSystemTracks(), true)
+	AssertEq("Thread Pid", t, ThreadPid(tr.Packet[2]), int32(os.Getpid()))
+	AssertEq("Disallow merging", t, tr.Packet[2].GetTrackDescriptor().GetDisallowMergingWithSystemTracks(), false)
+	AssertNeq("Tid", t, ThreadTid(tr.Packet[2]), 0)
+
+	td := ReadBack(t, trace)
+	if !reflect.DeepEqual(td.Processes[0], p) {
+		t.Errorf("For %s\ngot %+v\nexp %+v", "Process", td.Processes[0], p)
+	}
+	AssertEq("Thread", t, td.Threads[0], th)
+}
+
 // Adding several threads
 func TestAddManyThreads(t *testing.T) {
 	trace := NewTrace()
@@ -138,6 +201,90 @@ func TestSliceEvent(t *testing.T) {
 	AssertEq("end Track UUID", t, EventTrackUuid(pe2), t1.Uuid)
 }
 
+// Adding complete slices
+func TestSlice(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	trace.Slice(t1, 100, 50, "func1")
+	trace.Slice(t1, 200, 0, "func2")
+
+	td := ReadBack(t, trace)
+	exp := []Event{
+		{Timestamp: 100, Name: "func1", Type: pp.TrackEvent_TYPE_SLICE_BEGIN},
+		{Timestamp: 150, Type: pp.TrackEvent_TYPE_SLICE_END},
+		{Timestamp: 200, Name: "func2", Type: pp.TrackEvent_TYPE_SLICE_BEGIN},
+		{Timestamp: 200, Type: pp.TrackEvent_TYPE_SLICE_END},
+	}
+	AssertEq("Events", t, len(td.Events), len(exp))
+	for i := range exp {
+		exp[i].TrackUuid = t1.Uuid
+		AssertEvent(t, td.Events[i], exp[i])
+	}
+}
+
+// With SortEvents, events are emitted in timestamp order, so they
+// never fall back to absolute timestamps
+func TestSortEvents(t *testing.T) {
+	feat := DefaultFeatures
+	feat.SortEvents = true
+	trace := AddManyEvents(t, feat)
+	tr := RoundTrip(t, trace)
+	AssertEq("trace length", t, len(tr.Packet), 4+2*100+10)
+	AssertEq("Default clock", t, tr.Packet[0].GetTracePacketDefaults().GetTimestampClockId(), CustomClockID)
+	for _, p := range tr.Packet[4:] {
+		AssertEq("Clock", t, p.TimestampClockId, nil) // the default one
+	}
+
+	td := ReadBack(t, trace)
+	if !slices.IsSortedFunc(td.Events, func(a, b Event) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	}) {
+		t.Errorf("events are not sorted")
+	}
+}
+
+// Slices added out of order are nested correctly
+func TestSortEventsNesting(t *testing.T) {
+	trace := NewTrace(Features{Interning: true, IncrementalTS: true, SortEvents: true})
+	t1 := trace.AddTrack("track #1")
+	trace.Slice(t1, 100, 50, "c")
+	trace.Slice(t1, 50, 20, "b2")
+	trace.Slice(t1, 0, 50, "b1")
+	trace.Slice(t1, 0, 100, "a")
+	trace.Slice(t1, 100, 0, "zero")
+
+	td := ReadBack(t, trace)
+	var got []string
+	for _, e := range td.Events {
+		if e.Type == pp.TrackEvent_TYPE_SLICE_BEGIN {
+			got = append(got, fmt.Sprintf("B%v:%v", e.Timestamp, e.Name))
+		} else {
+			got = append(got, fmt.Sprintf("E%v", e.Timestamp))
+		}
+	}
+	exp := []string{
+		"B0:a", "B0:b1", "E50", "B50:b2", "E70", "E100",
+		"B100:c", "B100:zero", "E100", "E150",
+	}
+	if !slices.Equal(got, exp) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Events", got, exp)
+	}
+}
+
+// Slices that can't be added are reported
+func TestSliceErrors(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	c := trace.AddCounter("load", "", FloatValues())
+	if err := trace.With(OnClock(ClockMonotonic)).Slice(t1, 100, 50, "a"); !errors.Is(err, ErrUnknownClock) {
+		t.Errorf("For %s\ngot %v\nexp %v", "unknown clock", err, ErrUnknownClock)
+	}
+	if err := trace.With(ExtraCounter(c, 1)).Slice(t1, 100, 50, "b"); !errors.Is(err, ErrCounterKind) {
+		t.Errorf("For %s\ngot %v\nexp %v", "counter kind", err, ErrCounterKind)
+	}
+	AssertEq("Events", t, len(ReadBack(t, trace).Events), 0)
+}
+
 // Adding a Counter track
 func TestCounter(t *testing.T) {
 	trace := NewTrace(Features{Interning: true, IncrementalTS: false})
@@ -166,9 +313,221 @@ func TestCounter(t *testing.T) {
 	}
 }
 
+// Counter tracks take the options of basic tracks
+func TestCounterTrackOptions(t *testing.T) {
+	trace := NewTrace()
+	p := trace.AddProcess(1, "process #1")
+	c := trace.AddCounter("cpu load", "%", CounterTrack(Parent(p), Description("load of the cpu")))
+	AssertEq("Parent", t, c.ParentUuid, p.Uuid)
+
+	td := ReadBack(t, trace)
+	AssertEq("Parent", t, td.Counters[0].ParentUuid, p.Uuid)
+	AssertEq("Description", t, td.Counters[0].Description, "load of the cpu")
+}
+
+// Adding a Counter track with float values
+func TestFloatCounter(t *testing.T) {
+	trace := NewTrace()
+	load := trace.AddCounter("cpu load", "%", FloatValues())
+	for i := range uint64(10) {
+		if err := trace.NewFloatValue(load, 100*i, float64(i)/3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr := RoundTrip(t, trace)
+	for i, p := range tr.Packet[2:] {
+		AssertEq("Value", t, p.GetTrackEvent().GetDoubleCounterValue(), float64(i)/3)
+	}
+
+	td := ReadBack(t, trace)
+	AssertEq("IsFloat", t, td.Counters[0].IsFloat, true)
+	AssertEq("Events", t, len(td.Events), 10)
+	for i, e := range td.Events {
+		AssertEvent(t, e, Event{
+			Timestamp: 100 * uint64(i), Name: "cpu load", Type: pp.TrackEvent_TYPE_COUNTER,
+			IsCounter: true, IsFloat: true, FloatVal: float64(i) / 3, TrackUuid: load.Uuid,
+		})
+	}
+}
+
+// Int and float values can't be mixed on the same counter
+func TestCounterKind(t *testing.T) {
+	trace := NewTrace()
+	ic := trace.AddCounter("int", "")
+	fc := trace.AddCounter("float", "", FloatValues())
+	if err := trace.NewFloatValue(ic, 100, 1.5); !errors.Is(err, ErrCounterKind) {
+		t.Errorf("For %s\ngot %v\nexp %v", "float on int", err, ErrCounterKind)
+	}
+	if err := trace.NewValue(fc, 100, 1); !errors.Is(err, ErrCounterKind) {
+		t.Errorf("For %s\ngot %v\nexp %v", "int on float", err, ErrCounterKind)
+	}
+
+	td := ReadBack(t, trace)
+	AssertEq("Events", t, len(td.Events), 0)
+}
+
+// Incremental float counters are emitted as deltas too
+func TestIncrementalFloatCounter(t *testing.T) {
+	trace := NewTrace()
+	c := trace.AddCounter("cpu time", "s", FloatValues(), Incremental())
+	vals := []float64{0.5, 1.25, 2}
+	for i, v := range vals {
+		trace.NewFloatValue(c, uint64(i), v)
+	}
+
+	tr := RoundTrip(t, trace)
+	for i, exp := range []float64{0.5, 0.75, 0.75} {
+		AssertEq("delta", t, tr.Packet[2+i].GetTrackEvent().GetDoubleCounterValue(), exp)
+	}
+	td := ReadBack(t, trace)
+	for i, e := range td.Events {
+		AssertEq("value", t, e.FloatVal, vals[i])
+	}
+}
+
+// Counter values attached to slice events
+func TestExtraCounters(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	alloc := trace.AddCounter("bytes allocated", "B", Incremental())
+	depth := trace.AddCounter("queue depth", "")
+	load := trace.AddCounter("load", "", FloatValues())
+
+	trace.With(ExtraCounter(alloc, 100), ExtraCounter(depth, 3), ExtraFloatCounter(load, 0.5)).
+		StartSlice(t1, 100, "work")
+	trace.With(ExtraCounter(alloc, 300), ExtraCounter(depth, 1), ExtraFloatCounter(load, 0.25)).
+		EndSlice(t1, 200)
+	trace.With(ExtraCounter(depth, 2)).InstantEvent(t1, 300, "depth only")
+	trace.With(ExtraFloatCounter(load, 1)).InstantEvent(t1, 400, "load only")
+
+	tr := RoundTrip(t, trace)
+	defaults := tr.Packet[5].GetTracePacketDefaults().GetTrackEventDefaults()
+	AssertEq("defaults", t, len(defaults.GetExtraCounterTrackUuids()), 2)
+	AssertEq("defaults", t, len(defaults.GetExtraDoubleCounterTrackUuids()), 1)
+
+	// Events only carry the uuids that don't match the defaults
+	for i, exp := range []int{0, 0, 1, 0} {
+		te := tr.Packet[6+i].GetTrackEvent()
+		AssertEq("uuids", t, len(te.GetExtraCounterTrackUuids()), exp)
+		AssertEq("double uuids", t, len(te.GetExtraDoubleCounterTrackUuids()), 0)
+		AssertNeq("SequenceFlags", t, tr.Packet[6+i].GetSequenceFlags(), 0)
+	}
+	if got, exp := tr.Packet[7].GetTrackEvent().GetExtraCounterValues(), []int64{200, 1}; !slices.Equal(got, exp) {
+		t.Errorf("For %s\ngot %v\nexp %v", "incremental values", got, exp)
+	}
+
+	td := ReadBack(t, trace)
+	AssertEq("Events", t, len(td.Events), 4)
+	for i, exp := range [][]CounterSample{
+		{{TrackUuid: alloc.Uuid, Value: 100}, {TrackUuid: depth.Uuid, Value: 3}, {TrackUuid: load.Uuid, IsFloat: true, FloatVal: 0.5}},
+		{{TrackUuid: alloc.Uuid, Value: 300}, {TrackUuid: depth.Uuid, Value: 1}, {TrackUuid: load.Uuid, IsFloat: true, FloatVal: 0.25}},
+		{{TrackUuid: depth.Uuid, Value: 2}},
+		{{TrackUuid: load.Uuid, IsFloat: true, FloatVal: 1}},
+	} {
+		if got := td.Events[i].ExtraCounters; !slices.Equal(got, exp) {
+			t.Errorf("For %s\ngot %v\nexp %v", "ExtraCounters", got, exp)
+		}
+	}
+}
+
+// Extra counter values must match the kind of the counter
+func TestExtraCountersKind(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	load := trace.AddCounter("load", "", FloatValues())
+	err := trace.With(ExtraCounter(load, 1)).AddEvent(NewEvent(t1, pp.TrackEvent_TYPE_INSTANT, 100, "event", nil))
+	if !errors.Is(err, ErrCounterKind) {
+		t.Errorf("For %s\ngot %v\nexp %v", "int on float", err, ErrCounterKind)
+	}
+
+	// The event methods report the rejection too
+	h := trace.With(ExtraCounter(load, 1))
+	end := h.Begin(t1, "begin")
+	for name, err := range map[string]error{
+		"InstantEvent": h.InstantEvent(t1, 100, "instant"),
+		"StartSlice":   h.StartSlice(t1, 100, "slice"),
+		"Instant":      h.Instant(t1, "instant"),
+		"Log":          h.Log(t1, 100, PrioInfo, "log"),
+		"Begin":        end.Err(),
+		"End":          end.End(),
+	} {
+		if !errors.Is(err, ErrCounterKind) {
+			t.Errorf("For %s\ngot %v\nexp %v", name, err, ErrCounterKind)
+		}
+	}
+	td := ReadBack(t, trace)
+	AssertEq("Events", t, len(td.Events), 0)
+}
+
+// Counter descriptor fields are emitted and read back
+func TestCounterDescriptor(t *testing.T) {
+	trace := NewTrace()
+	mem := trace.AddCounter("heap", "", BuiltinUnit(UnitSizeBytes),
+		UnitMultiplier(1024), YAxisShareKey("mem"), CounterCategories("runtime"))
+	ins := trace.AddCounter("instructions", "", BuiltinCounter(CounterThreadInstructionCount))
+
+	tr := RoundTrip(t, trace)
+	cd := tr.Packet[1].GetTrackDescriptor().GetCounter()
+	AssertEq("Unit", t, cd.GetUnit(), pp.CounterDescriptor_UNIT_SIZE_BYTES)
+	AssertEq("UnitName", t, cd.UnitName == nil, true)
+	AssertEq("UnitMultiplier", t, cd.GetUnitMultiplier(), int64(1024))
+	AssertEq("YAxisShareKey", t, cd.GetYAxisShareKey(), "mem")
+
+	td := ReadBack(t, trace)
+	AssertEq("Counters", t, len(td.Counters), 2)
+	for i, exp := range []Counter{mem, ins} {
+		if !reflect.DeepEqual(td.Counters[i], exp) {
+			t.Errorf("For %s\ngot %+v\nexp %+v", "Counter", td.Counters[i], exp)
+		}
+	}
+}
+
+// Values of incremental counters are emitted as deltas, and restart
+// from zero after a Reset
+func TestIncrementalCounter(t *testing.T) {
+	deltas := func(trace Trace) []int64 {
+		var ds []int64
+		for _, p := range RoundTrip(t, trace).Packet {
+			if p.GetTrackEvent() != nil {
+				ds = append(ds, EventValue(p))
+				AssertNeq("SequenceFlags", t, p.GetSequenceFlags(), 0)
+			}
+		}
+		return ds
+	}
+
+	for _, feat := range []Features{DefaultFeatures, {IncrementalTS: true}} {
+		trace := NewTrace(feat)
+		rd := trace.AddCounter("bytes read", "B", Incremental())
+		vals := []int64{100, 150, 150, 400}
+		for i, v := range vals {
+			trace.NewValue(rd, uint64(100*i), v)
+		}
+
+		if got, exp := deltas(trace), []int64{100, 50, 0, 250}; !slices.Equal(got, exp) {
+			t.Errorf("For %s\ngot %v\nexp %v", "deltas", got, exp)
+		}
+		td := ReadBack(t, trace)
+		var got []int64
+		for _, e := range td.Events {
+			got = append(got, e.Value)
+		}
+		if !slices.Equal(got, vals) {
+			t.Errorf("For %s\ngot %v\nexp %v", "values", got, vals)
+		}
+
+		trace.Reset()
+		trace.NewValue(rd, 500, 500)
+		if got, exp := deltas(trace), []int64{500}; !slices.Equal(got, exp) {
+			t.Errorf("For %s\ngot %v\nexp %v", "deltas after Reset", got, exp)
+		}
+	}
+}
+
 // Returns a 1-process, 2-threads trace, with 100 slice events and 10
 // instant events.
-func AddManyEvents(t *testing.T, feat ...Features) Trace {
+func AddManyEvents(t testing.TB, feat ...Features) Trace {
 	t.Helper()
 	var trace Trace
 	if len(feat) > 0 {
@@ -356,6 +715,118 @@ func TestAnnotations(t *testing.T) {
 	}
 }
 
+func TestTypedAnnotations(t *testing.T) {
+	type point struct {
+		X, Y   int
+		Label  string `perfetto:"label"`
+		Hidden bool   `perfetto:"-"`
+		secret int
+	}
+
+	ann := Annotations{
+		{"string", "v1"},
+		{"int", -42},
+		{"int8", int8(-8)},
+		{"uint", uint32(42)},
+		{"double", 3.5},
+		{"bool", true},
+		{"pointer", Pointer(0xc000012345)},
+		{"json", JSON(`{"a": 1}`)},
+		{"error", fmt.Errorf("failed")},
+		{"dict", Annotations{{"a", 1}, {"b", "v1"}}},
+		{"map", map[string]float32{"y": 2, "x": 1}},
+		{"array", []string{"v1", "v2"}},
+		{"struct", &point{X: 1, Y: 2, Label: "p", Hidden: true, secret: 3}},
+	}
+	exp := Annotations{
+		{"string", "v1"},
+		{"int", int64(-42)},
+		{"int8", int64(-8)},
+		{"uint", uint64(42)},
+		{"double", 3.5},
+		{"bool", true},
+		{"pointer", Pointer(0xc000012345)},
+		{"json", JSON(`{"a": 1}`)},
+		{"error", "failed"},
+		{"dict", Annotations{{"a", int64(1)}, {"b", "v1"}}},
+		{"map", Annotations{{"x", 1.0}, {"y", 2.0}}},
+		{"array", []any{"v1", "v2"}},
+		{"struct", Annotations{{"X", int64(1)}, {"Y", int64(2)}, {"label", "p"}}},
+	}
+
+	for _, interning := range []bool{true, false} {
+		trace := NewTrace(Features{Interning: interning, IncrementalTS: true})
+		t1 := trace.AddTrack("track #1")
+		trace.StartSlice(t1, 100, "t1 func", ann)
+		trace.EndSlice(t1, 150)
+
+		td := ReadBack(t, trace)
+		if got := td.Events[0].Ann; !reflect.DeepEqual(got, exp) {
+			t.Errorf("For %s\ngot %v\nexp %v", "Annotations", got, exp)
+		}
+
+		// String leaves are interned, and every string is interned
+		// only once.
+		tr := RoundTrip(t, trace)
+		das := tr.Packet[2].GetTrackEvent().GetDebugAnnotations()
+		nested := das[11].GetArrayValues()[1]
+		if interning {
+			AssertNeq("nested string iid", t, nested.GetStringValueIid(), 0)
+			AssertEq("interned strings", t, len(tr.Packet[2].GetInternedData().GetDebugAnnotationStringValues()), 4)
+		} else {
+			AssertEq("nested string", t, nested.GetStringValue(), "v2")
+		}
+	}
+}
+
+// Typed nils with Error and String methods don't panic
+func TestNilAnnotations(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	ann := Annotations{{"url", (*url.URL)(nil)}, {"error", (*os.PathError)(nil)}}
+	if err := trace.AddEvent(NewEvent(t1, pp.TrackEvent_TYPE_INSTANT, 100, "event", nil, ann)); err != nil {
+		t.Fatal(err)
+	}
+
+	td := ReadBack(t, trace)
+	exp := Annotations{{"url", "<nil>"}, {"error", "<nil>"}}
+	if got := td.Events[0].Ann; !reflect.DeepEqual(got, exp) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Annotations", got, exp)
+	}
+}
+
+// Annotation names are interned once per sequence
+func TestAnnotationNamesInterning(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	for i := range 10 {
+		ann := Annotations{{"request_id", i}, {"args", Annotations{{"request_id", i}}}}
+		trace.InstantEvent(t1, uint64(i), "request")
+		trace.StartSlice(t1, uint64(i), "request", ann)
+	}
+
+	tr := RoundTrip(t, trace)
+	var names []string
+	for _, p := range tr.Packet {
+		for _, n := range p.GetInternedData().GetDebugAnnotationNames() {
+			names = append(names, n.GetName())
+		}
+		for _, da := range p.GetTrackEvent().GetDebugAnnotations() {
+			AssertEq("inline name", t, da.GetName(), "")
+			AssertNeq("name iid", t, da.GetNameIid(), 0)
+		}
+	}
+	if exp := []string{"request_id", "args"}; !slices.Equal(names, exp) {
+		t.Errorf("For %s\ngot %v\nexp %v", "interned names", names, exp)
+	}
+
+	td := ReadBack(t, trace)
+	exp := Annotations{{"request_id", int64(9)}, {"args", Annotations{{"request_id", int64(9)}}}}
+	if got := td.Events[len(td.Events)-1].Ann; !reflect.DeepEqual(got, exp) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Annotations", got, exp)
+	}
+}
+
 func TestFlows(t *testing.T) {
 	trace := NewTrace()
 	trace.AddProcess(1, "process #1")
@@ -375,6 +846,273 @@ func TestFlows(t *testing.T) {
 	}
 }
 
+// Events with correlation ids, with and without interning
+func TestCorrelation(t *testing.T) {
+	for _, feat := range []Features{DefaultFeatures, {IncrementalTS: true}} {
+		trace := NewTrace(feat)
+		t1 := trace.AddTrack("track #1")
+		t2 := trace.AddTrack("track #2")
+		req := trace.With(CorrelationStr("request 1"))
+		req.InstantEvent(t1, 100, "received")
+		req.InstantEvent(t2, 200, "handled")
+		trace.With(Correlation(42)).InstantEvent(t1, 300, "other")
+
+		tr := RoundTrip(t, trace)
+		te := tr.Packet[3].GetTrackEvent()
+		if feat.Interning {
+			AssertEq("interned ids", t, len(tr.Packet[3].GetInternedData().GetCorrelationIdStr()), 1)
+			AssertEq("interned ids", t, len(tr.Packet[4].GetInternedData().GetCorrelationIdStr()), 0)
+			AssertEq("iid", t, te.GetCorrelationIdStrIid(), tr.Packet[4].GetTrackEvent().GetCorrelationIdStrIid())
+		} else {
+			AssertEq("id", t, te.GetCorrelationIdStr(), "request 1")
+		}
+
+		td := ReadBack(t, trace)
+		AssertEq("Events", t, len(td.Events), 3)
+		for i, exp := range []string{"request 1", "request 1", ""} {
+			AssertEq("CorrelationIdStr", t, td.Events[i].CorrelationIdStr, exp)
+		}
+		AssertEq("CorrelationId", t, td.Events[2].CorrelationId, uint64(42))
+	}
+}
+
+// A streaming trace writes the same packets a buffered trace keeps
+func TestStreamingTrace(t *testing.T) {
+	var buf bytes.Buffer
+	trace := NewStreamingTrace(&buf)
+	trace.AddProcess(1, "process #1")
+	t1 := trace.AddThread(1, 1, "Thread #1")
+	for i := range uint64(10) {
+		trace.StartSlice(t1, i*100, "t1 func")
+		trace.EndSlice(t1, i*100+50)
+	}
+	if err := trace.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	AssertEq("buffered trace length", t, len(RoundTrip(t, trace).Packet), 0)
+
+	var tr pp.Trace
+	if err := proto.Unmarshal(buf.Bytes(), &tr); err != nil {
+		t.Fatal(err)
+	}
+	AssertEq("trace length", t, len(tr.Packet), 3+2*10)
+	AssertEq("Thread Name", t, ThreadName(tr.Packet[2]), "Thread #1")
+	for i, p := range tr.Packet[3:] {
+		if i%2 == 0 {
+			AssertEq("Type", t, EventType(p), "TYPE_SLICE_BEGIN")
+			AssertEq("NameIid", t, EventNameIid(p), 1)
+		} else {
+			AssertEq("Type", t, EventType(p), "TYPE_SLICE_END")
+		}
+		AssertEq("Track UUID", t, EventTrackUuid(p), t1.Uuid)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("write failed")
+}
+
+func TestStreamingTraceError(t *testing.T) {
+	trace := NewStreamingTrace(failingWriter{})
+	trace.AddTrack("track #1")
+	if err := trace.Flush(); err == nil {
+		t.Errorf("expected an error from Flush")
+	}
+}
+
+// After a Reset, a new self-contained chunk starts
+func TestReset(t *testing.T) {
+	var buf bytes.Buffer
+	trace := NewStreamingTrace(&buf)
+	t1 := trace.AddTrack("track #1")
+	trace.StartSlice(t1, 100, "func1")
+	trace.EndSlice(t1, 150)
+
+	buf.Reset()
+	trace.Reset()
+	trace.StartSlice(t1, 200, "func2")
+	trace.EndSlice(t1, 300)
+
+	var tr pp.Trace
+	if err := proto.Unmarshal(buf.Bytes(), &tr); err != nil {
+		t.Fatal(err)
+	}
+	AssertEq("trace length", t, len(tr.Packet), 4)
+	AssertNeq("Clock Snapshot", t, tr.Packet[0].GetClockSnapshot(), nil)
+	AssertEq("Name", t, BasicTrackName(tr.Packet[1]), "track #1")
+
+	p := tr.Packet[2]
+	AssertEq("Timestamp", t, EventTimestamp(p), 200) // incremental, from 0
+	AssertEq("NameIid", t, EventNameIid(p), 1)       // interning restarted
+	AssertEq("Interned Name", t, p.GetInternedData().GetEventNames()[0].GetName(), "func2")
+	// the chunk starts with the snapshot, that carries the defaults
+	AssertEq("SequenceFlags", t, tr.Packet[0].GetSequenceFlags(), uint32(
+		pp.TracePacket_SEQ_INCREMENTAL_STATE_CLEARED|pp.TracePacket_SEQ_NEEDS_INCREMENTAL_STATE))
+	for _, p := range tr.Packet[2:] {
+		AssertEq("SequenceFlags", t, p.GetSequenceFlags(), uint32(
+			pp.TracePacket_SEQ_NEEDS_INCREMENTAL_STATE))
+	}
+
+	// Buffered traces get the same new chunk
+	trace = NewTrace()
+	t1 = trace.AddTrack("track #1")
+	trace.StartSlice(t1, 100, "func1")
+	trace.Reset()
+	AssertEq("trace length", t, len(RoundTrip(t, trace).Packet), 2)
+}
+
+// Returns the same trace as AddManyEvents, with the events of each
+// thread on its own track sequence.
+func AddManyEventsTrackSequences(t testing.TB) Trace {
+	t.Helper()
+	trace := NewTrace()
+	trace.AddProcess(1, "process #1")
+	t1 := trace.AddThread(1, 1, "Thread #1")
+	t2 := trace.AddThread(1, 2, "Thread #2")
+	s1, s2 := trace.NewTrackSequence(t1), trace.NewTrackSequence(t2)
+
+	for i := range uint64(100) {
+		if i%2 == 0 {
+			s1.StartSlice(t1, i*100, "t1 func")
+			s1.EndSlice(t1, i*100+50)
+		} else {
+			s2.StartSlice(t2, i*100, "t2 func")
+			s2.EndSlice(t2, i*100+50)
+		}
+	}
+	for i := range uint64(10) {
+		s1.InstantEvent(t1, i*100, "Instant event")
+	}
+
+	return trace
+}
+
+// Events on the default track of a sequence omit the track uuid
+func TestTrackSequence(t *testing.T) {
+	for _, feat := range []Features{DefaultFeatures, {}} {
+		trace := NewTrace(feat)
+		t1 := trace.AddTrack("track #1")
+		t2 := trace.AddTrack("track #2")
+		seq := trace.NewTrackSequence(t1)
+		seq.InstantEvent(t1, 100, "default track")
+		seq.InstantEvent(t2, 200, "other track")
+
+		tr := RoundTrip(t, trace)
+		var events []*pp.TracePacket
+		for _, p := range tr.Packet {
+			if d := p.GetTracePacketDefaults(); d.GetTrackEventDefaults() != nil {
+				AssertEq("default track", t, d.GetTrackEventDefaults().GetTrackUuid(), t1.Uuid)
+			}
+			if p.GetTrackEvent() != nil {
+				events = append(events, p)
+			}
+		}
+		AssertEq("track uuid", t, events[0].GetTrackEvent().TrackUuid, nil)
+		AssertEq("track uuid", t, events[1].GetTrackEvent().GetTrackUuid(), t2.Uuid)
+
+		td := ReadBack(t, trace)
+		AssertEq("TrackUuid", t, td.Events[0].TrackUuid, t1.Uuid)
+		AssertEq("TrackUuid", t, td.Events[1].TrackUuid, t2.Uuid)
+	}
+
+	// The defaults make the trace smaller
+	def, err := AddManyEvents(t).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqs, err := AddManyEventsTrackSequences(t).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) >= len(def) {
+		t.Errorf("trace with track sequences is %d bytes, default one is %d", len(seqs), len(def))
+	}
+}
+
+func BenchmarkManyEvents(b *testing.B) {
+	for _, bb := range []struct {
+		name string
+		add  func(testing.TB) Trace
+	}{
+		{"DefaultFeatures", func(tb testing.TB) Trace { return AddManyEvents(tb) }},
+		{"TrackSequences", AddManyEventsTrackSequences},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			var size int
+			for range b.N {
+				data, err := bb.add(b).Marshal()
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(data)
+			}
+			b.ReportMetric(float64(size), "bytes/trace")
+		})
+	}
+}
+
+// Adding events from several goroutines, each on its own sequence
+func TestSequences(t *testing.T) {
+	trace := NewTrace()
+	trace.AddProcess(1, "process #1")
+
+	var wg sync.WaitGroup
+	for i := range int32(8) {
+		seq := trace.NewSequence()
+		th := seq.AddThread(1, i+1, fmt.Sprintf("Thread #%v", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range uint64(100) {
+				seq.StartSlice(th, j*100, "func")
+				seq.EndSlice(th, j*100+50)
+			}
+		}()
+	}
+	wg.Wait()
+
+	tr := RoundTrip(t, trace)
+	AssertEq("trace length", t, len(tr.Packet), 1+1+8*(1+1+200))
+
+	// Every sequence has its own clock and interning tables
+	type seqState struct {
+		ts     uint64
+		events int
+	}
+	seqs := make(map[uint32]*seqState)
+	for _, p := range tr.Packet {
+		id := p.GetTrustedPacketSequenceId()
+		if p.GetClockSnapshot() != nil {
+			seqs[id] = &seqState{}
+			continue
+		}
+		if p.GetTrackEvent() == nil {
+			continue
+		}
+		s, ok := seqs[id]
+		if !ok {
+			t.Fatalf("event on sequence %v before its clock snapshot", id)
+		}
+		s.ts += EventTimestamp(p)
+		if EventType(p) == "TYPE_SLICE_BEGIN" {
+			AssertEq("Timestamp", t, s.ts, uint64(s.events/2)*100)
+			AssertEq("NameIid", t, EventNameIid(p), 1)
+		} else {
+			AssertEq("Timestamp", t, s.ts, uint64(s.events/2)*100+50)
+		}
+		s.events++
+	}
+	AssertEq("sequences", t, len(seqs), 9)
+	for id, s := range seqs {
+		if id != TPSID {
+			AssertEq("sequence events", t, s.events, 200)
+		}
+	}
+}
+
 // ---- { testing helpers } --------------------------------
 
 func RoundTrip(t *testing.T, trace Trace) pp.Trace {
@@ -0,0 +1,82 @@
+package perfetto
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// gettid returns the id of the OS thread the caller is running on.
+func gettid() int32 {
+	return int32(syscall.Gettid())
+}
+
+// userHZ is the frequency of the clock ticks in /proc/<pid>/stat.
+const userHZ = 100
+
+// FromProc returns the process with the given pid, as described by
+// /proc/<pid>: its name, command line, start time and nice value (as
+// the priority). It can be added to a trace with AddProcessTrack.
+func FromProc(pid int32) (Process, error) {
+	dir := fmt.Sprintf("/proc/%d", pid)
+	name, err := readProcName(dir)
+	if err != nil {
+		return Process{}, err
+	}
+	cmdline, err := os.ReadFile(dir + "/cmdline")
+	if err != nil {
+		return Process{}, err
+	}
+	stat, err := os.ReadFile(dir + "/stat")
+	if err != nil {
+		return Process{}, err
+	}
+
+	// The name in the stat file can contain spaces, so the fields are
+	// counted from the parenthesis that ends it. Fields are numbered
+	// as in proc(5), from the state (3).
+	i := strings.LastIndexByte(string(stat), ')')
+	fields := strings.Fields(string(stat[i+1:]))
+	if i < 0 || len(fields) < 20 {
+		return Process{}, fmt.Errorf("malformed %s/stat", dir)
+	}
+	field := func(n int) string { return fields[n-3] }
+	nice, err := strconv.ParseInt(field(19), 10, 32)
+	if err != nil {
+		return Process{}, fmt.Errorf("%s/stat: %w", dir, err)
+	}
+	start, err := strconv.ParseUint(field(22), 10, 64)
+	if err != nil {
+		return Process{}, fmt.Errorf("%s/stat: %w", dir, err)
+	}
+
+	p := NewProcess(pid, name)
+	if args := strings.TrimSuffix(string(cmdline), "\x00"); args != "" {
+		p.Cmdline = strings.Split(args, "\x00")
+	}
+	p.StartTimestamp = start * uint64(time.Second/userHZ)
+	p.Priority = int32(nice)
+	return p, nil
+}
+
+// ThreadFromProc returns the thread with the given pid and tid, named
+// as in /proc/<pid>/task/<tid>. It can be added to a trace with
+// AddThreadTrack.
+func ThreadFromProc(pid, tid int32) (Thread, error) {
+	name, err := readProcName(fmt.Sprintf("/proc/%d/task/%d", pid, tid))
+	if err != nil {
+		return Thread{}, err
+	}
+	return NewThread(pid, tid, name), nil
+}
+
+func readProcName(dir string) (string, error) {
+	comm, err := os.ReadFile(dir + "/comm")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(comm), "\n"), nil
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package perfetto
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// gettid returns the id of the OS thread the caller is running on.
+// Outside Linux, it's the process id.
+func gettid() int32 {
+	return int32(os.Getpid())
+}
+
+// FromProc returns the process with the given pid, as described by
+// /proc/<pid>. It's only supported on Linux.
+func FromProc(pid int32) (Process, error) {
+	return Process{}, fmt.Errorf("FromProc: %w", errors.ErrUnsupported)
+}
+
+// ThreadFromProc returns the thread with the given pid and tid, as
+// described by /proc/<pid>/task/<tid>. It's only supported on Linux.
+func ThreadFromProc(pid, tid int32) (Thread, error) {
+	return Thread{}, fmt.Errorf("ThreadFromProc: %w", errors.ErrUnsupported)
+}
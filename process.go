@@ -0,0 +1,93 @@
+package perfetto
+
+import (
+	"slices"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// -- { Process and thread lifecycle } --------------------------------
+
+// AddProcessTrack adds p, a process returned by NewProcess or
+// FromProc, to the trace. It returns a handle that can be used to
+// associate events to the process, which has a new uuid if the one of
+// p is already taken.
+func (t *Trace) AddProcessTrack(p Process) Process {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	return t.addProcess(p)
+}
+
+// AddThreadTrack is like AddProcessTrack, for a thread returned by
+// NewThread or ThreadFromProc.
+func (t *Trace) AddThreadTrack(th Thread) Thread {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	return t.addThread(th)
+}
+
+// RenameProcess renames the process at ts, by emitting its descriptor
+// again with a timestamp. It returns the renamed process.
+func (t *Trace) RenameProcess(p Process, ts uint64, name string) Process {
+	p.Name = name
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	t.reemitTrack(p.Emit(), ts, false)
+	t.st.reg.replace(p)
+	return p
+}
+
+// RenameThread renames the thread at ts, by emitting its descriptor
+// again with a timestamp. It returns the renamed thread.
+func (t *Trace) RenameThread(th Thread, ts uint64, name string) Thread {
+	th.Name = name
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	t.reemitTrack(th.Emit(), ts, false)
+	t.st.reg.replace(th)
+	if t.Threads[th.Tid].Uuid == th.Uuid {
+		t.Threads[th.Tid] = th
+	}
+	return th
+}
+
+// EndProcess marks the process as ended at ts, by emitting its
+// descriptor one last time with a timestamp. The process is no longer
+// returned by Process and GetOrAddProcess, so that its pid can be
+// reused by another process, and it's not described again in the
+// chunks that start after a Reset.
+func (t *Trace) EndProcess(p Process, ts uint64) {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	t.reemitTrack(p.Emit(), ts, true)
+	t.st.reg.end(p)
+}
+
+// EndThread is like EndProcess, for a thread.
+func (t *Trace) EndThread(th Thread, ts uint64) {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	t.reemitTrack(th.Emit(), ts, true)
+	t.st.reg.end(th)
+}
+
+// reemitTrack emits td, the descriptor of a track of the trace, again
+// at ts. Unless the track has ended, td replaces the descriptor of the
+// track emitted at the start of new chunks.
+func (t *Trace) reemitTrack(td *pp.TracePacket_TrackDescriptor, ts uint64, ended bool) {
+	tp := &pp.TracePacket{Data: td, Timestamp: proto.Uint64(t.st.boottime + ts)}
+	uuid := td.TrackDescriptor.GetUuid()
+	i := slices.IndexFunc(t.st.tracks, func(p *pp.TracePacket) bool {
+		return p.GetTrackDescriptor().GetUuid() == uuid
+	})
+	switch {
+	case i < 0 && !ended:
+		t.st.tracks = append(t.st.tracks, tp)
+	case i >= 0 && ended:
+		t.st.tracks = slices.Delete(t.st.tracks, i, i+1)
+	case i >= 0:
+		t.st.tracks[i] = tp
+	}
+	t.emit(tp)
+}
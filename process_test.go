@@ -0,0 +1,103 @@
+package perfetto
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestProcessDescriptor(t *testing.T) {
+	trace := NewTrace()
+	p := NewProcess(1, "server", DisallowMerging())
+	p.Cmdline = []string{"/usr/bin/server", "-v"}
+	p.StartTimestamp = 1000
+	p.Labels = []string{"frontend"}
+	p.Priority = -5
+	p = trace.AddProcessTrack(p)
+
+	tr := RoundTrip(t, trace)
+	desc := tr.Packet[1].GetTrackDescriptor().GetProcess()
+	if !slices.Equal(desc.GetCmdline(), p.Cmdline) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Cmdline", desc.GetCmdline(), p.Cmdline)
+	}
+	AssertEq("Start", t, desc.GetStartTimestampNs(), 1000)
+	AssertEq("Priority", t, desc.GetProcessPriority(), -5)
+
+	td := ReadBack(t, trace)
+	if !reflect.DeepEqual(td.Processes[0], p) {
+		t.Errorf("For %s\ngot %+v\nexp %+v", "Process", td.Processes[0], p)
+	}
+}
+
+// Renamed and ended tracks are described again at the right time
+func TestProcessLifecycle(t *testing.T) {
+	trace := NewTrace()
+	p := trace.AddProcess(1, "process #1")
+	th := trace.AddThread(1, 10, "thread")
+	th = trace.RenameThread(th, 100, "worker")
+	trace.EndProcess(p, 200)
+
+	tr := RoundTrip(t, trace)
+	AssertEq("trace length", t, len(tr.Packet), 5)
+	AssertEq("Rename ts", t, tr.Packet[3].GetTimestamp(), 100)
+	AssertEq("Name", t, ThreadName(tr.Packet[3]), "worker")
+	AssertEq("End ts", t, tr.Packet[4].GetTimestamp(), 200)
+
+	got, ok := trace.Thread(1, 10)
+	AssertEq("Found", t, ok, true)
+	AssertEq("Thread", t, got, th)
+	if _, ok := trace.Process(1); ok {
+		t.Errorf("found a process that has ended")
+	}
+	AssertNeq("Process", t, trace.GetOrAddProcess(1, "process #1").Uuid, p.Uuid)
+
+	td := ReadBack(t, trace)
+	AssertEq("Processes", t, len(td.Processes), 2)
+	AssertEq("Threads", t, len(td.Threads), 1)
+	AssertEq("Thread", t, td.Threads[0], th)
+
+	// The ended process is not described in the next chunk
+	trace.Reset()
+	tr = RoundTrip(t, trace)
+	var uuids []uint64
+	for _, p := range tr.Packet {
+		if d := p.GetTrackDescriptor(); d != nil {
+			uuids = append(uuids, d.GetUuid())
+		}
+	}
+	AssertEq("Descriptors", t, len(uuids), 2)
+	AssertEq("Thread", t, uuids[0], th.Uuid)
+	AssertEq("Name", t, ThreadName(tr.Packet[1]), "worker")
+}
+
+func TestFromProc(t *testing.T) {
+	p, err := FromProc(int32(os.Getpid()))
+	if runtime.GOOS != "linux" {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			t.Errorf("For %s\ngot %v\nexp %v", "error", err, errors.ErrUnsupported)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEq("Pid", t, p.Pid, int32(os.Getpid()))
+	AssertNeq("Name", t, p.Name, "")
+	if !slices.Equal(p.Cmdline, os.Args) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Cmdline", p.Cmdline, os.Args)
+	}
+	AssertNeq("Start", t, p.StartTimestamp, 0)
+
+	th, err := ThreadFromProc(p.Pid, p.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEq("Thread name", t, th.Name, p.Name)
+
+	if _, err := FromProc(-1); err == nil {
+		t.Errorf("expected an error for a process that doesn't exist")
+	}
+}
@@ -0,0 +1,550 @@
+package perfetto
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+)
+
+// -- { Reader } --------------------------------
+
+// TraceData holds the tracks and the events read from a trace, in the
+// order they appear in the trace.
+type TraceData struct {
+	Tracks    []BasicTrack
+	Processes []Process
+	Threads   []Thread
+	Counters  []Counter
+	Events    []Event
+}
+
+// ReadTrace parses a perfetto trace from r. Interned data is resolved
+// and incremental timestamps are turned back into absolute ones, so
+// the returned Events look like the ones that were added to the
+// trace. Track descriptors that appear more than once (for example
+// after a Reset) are only returned once, and processes and threads
+// that are renamed get their last name.
+//
+// Timestamps on the trace clock are returned as boottimes, which are
+// the timestamps that were added unless the trace is anchored by a
+// BOOTTIME clock domain. Timestamps on other clocks are returned as
+// they are, with the Clock of the event set.
+func ReadTrace(r io.Reader) (*TraceData, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var pt pp.Trace
+	if err := proto.Unmarshal(data, &pt); err != nil {
+		return nil, err
+	}
+
+	td := &TraceData{}
+	seen := make(map[uint64]bool)          // uuids of the tracks read so far
+	incr := make(map[uint64]bool)          // uuids of the incremental counters
+	floats := make(map[uint64]bool)        // uuids of the counters with float values
+	seqs := make(map[uint32]*readSequence) // by trusted_packet_sequence_id
+	for i, tp := range pt.Packet {
+		s, ok := seqs[tp.GetTrustedPacketSequenceId()]
+		if !ok {
+			s = newReadSequence(incr)
+			seqs[tp.GetTrustedPacketSequenceId()] = s
+		}
+		if tp.GetSequenceFlags()&uint32(pp.TracePacket_SEQ_INCREMENTAL_STATE_CLEARED) != 0 {
+			s.clear()
+		}
+		if d := tp.GetTracePacketDefaults(); d != nil {
+			s.defaults(d)
+		}
+
+		switch {
+		case tp.GetTrackDescriptor() != nil:
+			desc := tp.GetTrackDescriptor()
+			if !seen[desc.GetUuid()] {
+				seen[desc.GetUuid()] = true
+				td.addTrack(desc)
+			} else {
+				td.updateTrack(desc)
+			}
+			if desc.GetCounter().GetIsIncremental() {
+				incr[desc.GetUuid()] = true
+			}
+		case tp.GetClockSnapshot() != nil:
+			s.snapshot(tp.GetClockSnapshot())
+		case tp.GetTrackEvent() != nil:
+			e, err := s.event(tp)
+			if err != nil {
+				return nil, fmt.Errorf("packet %d: %w", i, err)
+			}
+			td.Events = append(td.Events, e)
+			if e.IsFloat {
+				floats[e.TrackUuid] = true
+			}
+		}
+	}
+
+	// The descriptor doesn't say whether the counter values are floats,
+	// so look at the values.
+	for i, c := range td.Counters {
+		td.Counters[i].IsFloat = floats[c.Uuid]
+	}
+
+	return td, nil
+}
+
+func (td *TraceData) addTrack(desc *pp.TrackDescriptor) {
+	bt := BasicTrack{
+		Name:             desc.GetName(),
+		Uuid:             desc.GetUuid(),
+		ParentUuid:       desc.GetParentUuid(),
+		Description:      desc.GetDescription(),
+		ChildOrdering:    Ordering(desc.GetChildOrdering()),
+		SiblingOrderRank: desc.GetSiblingOrderRank(),
+		DisallowMerging:  desc.GetDisallowMergingWithSystemTracks(),
+	}
+	if name, ok := desc.GetStaticOrDynamicName().(*pp.TrackDescriptor_StaticName); ok {
+		bt.Name, bt.StaticName = name.StaticName, true
+	}
+	switch {
+	case desc.GetProcess() != nil:
+		p := desc.GetProcess()
+		bt.Name = p.GetProcessName()
+		td.Processes = append(td.Processes, Process{
+			BasicTrack:     bt,
+			Pid:            p.GetPid(),
+			Cmdline:        p.GetCmdline(),
+			StartTimestamp: uint64(p.GetStartTimestampNs()),
+			Labels:         p.GetProcessLabels(),
+			Priority:       p.GetProcessPriority(),
+		})
+	case desc.GetThread() != nil:
+		t := desc.GetThread()
+		bt.Name = t.GetThreadName()
+		td.Threads = append(td.Threads, Thread{BasicTrack: bt, Pid: t.GetPid(), Tid: t.GetTid()})
+	case desc.GetCounter() != nil:
+		cd := desc.GetCounter()
+		td.Counters = append(td.Counters, Counter{
+			BasicTrack:     bt,
+			Unit:           cd.GetUnitName(),
+			BuiltinUnit:    Unit(cd.GetUnit()),
+			UnitMultiplier: cd.GetUnitMultiplier(),
+			IsIncremental:  cd.GetIsIncremental(),
+			YAxisShareKey:  cd.GetYAxisShareKey(),
+			Categories:     cd.GetCategories(),
+			Type:           CounterType(cd.GetType()),
+		})
+	default:
+		td.Tracks = append(td.Tracks, bt)
+	}
+}
+
+// updateTrack updates the process or thread described again by desc.
+func (td *TraceData) updateTrack(desc *pp.TrackDescriptor) {
+	var upd TraceData
+	upd.addTrack(desc)
+	for i, p := range td.Processes {
+		if len(upd.Processes) > 0 && p.Uuid == desc.GetUuid() {
+			td.Processes[i] = upd.Processes[0]
+		}
+	}
+	for i, t := range td.Threads {
+		if len(upd.Threads) > 0 && t.Uuid == desc.GetUuid() {
+			td.Threads[i] = upd.Threads[0]
+		}
+	}
+}
+
+// readSequence holds the incremental state of a packet sequence while
+// the trace is being read.
+type readSequence struct {
+	eventNames   map[uint64]string
+	categories   map[uint64]string
+	annNames     map[uint64]string
+	annValues    map[uint64]string
+	correlations map[uint64]string
+	locations    map[uint64]SourceLocation
+	logBodies    map[uint64]string
+	functions    map[uint64]string
+	mappingPaths map[uint64]string
+	mappings     map[uint64]string // path of the mappings
+	frames       map[uint64]Frame
+	callstacks   map[uint64][]Frame
+	clocks       map[uint32]uint64  // current value of the incremental clocks
+	offsets      map[uint32]uint64  // boottime of the zero of the incremental clocks
+	counters     map[uint64]int64   // current value of the incremental counters
+	fcounters    map[uint64]float64 // current value of the incremental float counters
+	incr         map[uint64]bool    // uuids of the incremental counters
+
+	// from the TracePacketDefaults
+	clockDefault         uint32
+	trackDefault         uint64
+	counterDefaults      []uint64
+	floatCounterDefaults []uint64
+}
+
+func newReadSequence(incr map[uint64]bool) *readSequence {
+	s := &readSequence{clocks: make(map[uint32]uint64), offsets: make(map[uint32]uint64), incr: incr}
+	s.clear()
+	return s
+}
+
+// clear drops the incremental state of the sequence.
+func (s *readSequence) clear() {
+	s.counters = make(map[uint64]int64)
+	s.fcounters = make(map[uint64]float64)
+	s.clockDefault, s.trackDefault = 0, 0
+	s.counterDefaults, s.floatCounterDefaults = nil, nil
+	s.eventNames = make(map[uint64]string)
+	s.categories = make(map[uint64]string)
+	s.annNames = make(map[uint64]string)
+	s.annValues = make(map[uint64]string)
+	s.correlations = make(map[uint64]string)
+	s.locations = make(map[uint64]SourceLocation)
+	s.logBodies = make(map[uint64]string)
+	s.functions = make(map[uint64]string)
+	s.mappingPaths = make(map[uint64]string)
+	s.mappings = make(map[uint64]string)
+	s.frames = make(map[uint64]Frame)
+	s.callstacks = make(map[uint64][]Frame)
+}
+
+func (s *readSequence) defaults(d *pp.TracePacketDefaults) {
+	s.clockDefault = d.GetTimestampClockId()
+	s.trackDefault = d.GetTrackEventDefaults().GetTrackUuid()
+	s.counterDefaults = d.GetTrackEventDefaults().GetExtraCounterTrackUuids()
+	s.floatCounterDefaults = d.GetTrackEventDefaults().GetExtraDoubleCounterTrackUuids()
+}
+
+func (s *readSequence) snapshot(cs *pp.ClockSnapshot) {
+	var boottime uint64
+	for _, c := range cs.GetClocks() {
+		if c.GetClockId() == uint32(ClockBoottime) {
+			boottime = c.GetTimestamp()
+		}
+	}
+	for _, c := range cs.GetClocks() {
+		if c.GetIsIncremental() {
+			s.clocks[c.GetClockId()] = c.GetTimestamp()
+			s.offsets[c.GetClockId()] = boottime - c.GetTimestamp()
+		}
+	}
+}
+
+func (s *readSequence) intern(data *pp.InternedData) {
+	for _, en := range data.GetEventNames() {
+		s.eventNames[en.GetIid()] = en.GetName()
+	}
+	for _, ec := range data.GetEventCategories() {
+		s.categories[ec.GetIid()] = ec.GetName()
+	}
+	for _, an := range data.GetDebugAnnotationNames() {
+		s.annNames[an.GetIid()] = an.GetName()
+	}
+	for _, av := range data.GetDebugAnnotationStringValues() {
+		s.annValues[av.GetIid()] = string(av.GetStr())
+	}
+	for _, c := range data.GetCorrelationIdStr() {
+		s.correlations[c.GetIid()] = string(c.GetStr())
+	}
+	for _, sl := range data.GetSourceLocations() {
+		s.locations[sl.GetIid()] = sourceLocation(sl)
+	}
+	for _, lb := range data.GetLogMessageBody() {
+		s.logBodies[lb.GetIid()] = lb.GetBody()
+	}
+
+	// Callstacks refer to frames, that refer to function names and
+	// mappings, that refer to mapping paths.
+	for _, fn := range data.GetFunctionNames() {
+		s.functions[fn.GetIid()] = string(fn.GetStr())
+	}
+	for _, mp := range data.GetMappingPaths() {
+		s.mappingPaths[mp.GetIid()] = string(mp.GetStr())
+	}
+	for _, m := range data.GetMappings() {
+		var path []string
+		for _, id := range m.GetPathStringIds() {
+			path = append(path, s.mappingPaths[id])
+		}
+		s.mappings[m.GetIid()] = strings.Join(path, "/")
+	}
+	for _, f := range data.GetFrames() {
+		s.frames[f.GetIid()] = Frame{
+			Function: s.functions[f.GetFunctionNameId()],
+			PC:       f.GetRelPc(),
+			Mapping:  s.mappings[f.GetMappingId()],
+		}
+	}
+	for _, cs := range data.GetCallstacks() {
+		var frames []Frame
+		for _, id := range cs.GetFrameIds() {
+			frames = append(frames, s.frames[id])
+		}
+		s.callstacks[cs.GetIid()] = frames
+	}
+}
+
+// timestamp returns the absolute timestamp of the packet, and its
+// clock if it's not the trace clock.
+func (s *readSequence) timestamp(tp *pp.TracePacket) (uint64, ClockID, error) {
+	id := s.clockDefault
+	if tp.TimestampClockId != nil {
+		id = tp.GetTimestampClockId()
+	}
+	switch {
+	case id == 0 || id == uint32(ClockBoottime):
+		// the default clock of the trace processor
+		return tp.GetTimestamp(), 0, nil
+	case id < 64 || id >= 128:
+		// the other builtin clocks and the user-defined ones
+		return tp.GetTimestamp(), ClockID(id), nil
+	}
+	ts, ok := s.clocks[id]
+	if !ok {
+		return 0, 0, fmt.Errorf("timestamp on clock %d, but the clock has no snapshot", id)
+	}
+	ts += tp.GetTimestamp()
+	s.clocks[id] = ts
+	return ts + s.offsets[id], 0, nil
+}
+
+func (s *readSequence) event(tp *pp.TracePacket) (Event, error) {
+	s.intern(tp.GetInternedData())
+
+	ts, clock, err := s.timestamp(tp)
+	if err != nil {
+		return Event{}, err
+	}
+
+	te := tp.GetTrackEvent()
+	e := Event{
+		Timestamp:        ts,
+		Clock:            clock,
+		Name:             te.GetName(),
+		Type:             te.GetType(),
+		TrackUuid:        s.trackDefault,
+		Flows:            te.GetFlowIds(),
+		TerminatingFlows: te.GetTerminatingFlowIds(),
+	}
+	if te.TrackUuid != nil {
+		e.TrackUuid = te.GetTrackUuid()
+	}
+	if iid := te.GetNameIid(); iid != 0 {
+		name, ok := s.eventNames[iid]
+		if !ok {
+			return Event{}, fmt.Errorf("unknown event name iid %d", iid)
+		}
+		e.Name = name
+	}
+	e.Categories = te.GetCategories()
+	for _, iid := range te.GetCategoryIids() {
+		cat, ok := s.categories[iid]
+		if !ok {
+			return Event{}, fmt.Errorf("unknown event category iid %d", iid)
+		}
+		e.Categories = append(e.Categories, cat)
+	}
+	switch v := te.GetSourceLocationField().(type) {
+	case *pp.TrackEvent_SourceLocation:
+		e.Location = sourceLocation(v.SourceLocation)
+	case *pp.TrackEvent_SourceLocationIid:
+		loc, ok := s.locations[v.SourceLocationIid]
+		if !ok {
+			return Event{}, fmt.Errorf("unknown source location iid %d", v.SourceLocationIid)
+		}
+		e.Location = loc
+	}
+	if lm := te.GetLogMessage(); lm != nil {
+		body, ok := s.logBodies[lm.GetBodyIid()]
+		if !ok {
+			return Event{}, fmt.Errorf("unknown log message body iid %d", lm.GetBodyIid())
+		}
+		e.Log = &LogMessage{Priority: Priority(lm.GetPrio()), Body: body}
+		if iid := lm.GetSourceLocationIid(); iid != 0 {
+			if e.Location, ok = s.locations[iid]; !ok {
+				return Event{}, fmt.Errorf("unknown source location iid %d", iid)
+			}
+		}
+	}
+	switch v := te.GetCorrelationIdField().(type) {
+	case *pp.TrackEvent_CorrelationId:
+		e.CorrelationId = v.CorrelationId
+	case *pp.TrackEvent_CorrelationIdStr:
+		e.CorrelationIdStr = v.CorrelationIdStr
+	case *pp.TrackEvent_CorrelationIdStrIid:
+		id, ok := s.correlations[v.CorrelationIdStrIid]
+		if !ok {
+			return Event{}, fmt.Errorf("unknown correlation id iid %d", v.CorrelationIdStrIid)
+		}
+		e.CorrelationIdStr = id
+	}
+	switch v := te.GetCounterValueField().(type) {
+	case *pp.TrackEvent_CounterValue:
+		e.IsCounter = true
+		e.Value = v.CounterValue
+		if s.incr[e.TrackUuid] {
+			e.Value += s.counters[e.TrackUuid]
+			s.counters[e.TrackUuid] = e.Value
+		}
+	case *pp.TrackEvent_DoubleCounterValue:
+		e.IsCounter, e.IsFloat = true, true
+		e.FloatVal = v.DoubleCounterValue
+		if s.incr[e.TrackUuid] {
+			e.FloatVal += s.fcounters[e.TrackUuid]
+			s.fcounters[e.TrackUuid] = e.FloatVal
+		}
+	}
+
+	e.ExtraCounters, err = s.extraCounters(te)
+	if err != nil {
+		return Event{}, err
+	}
+
+	e.Ann, err = s.annotations(te.GetDebugAnnotations())
+	if err != nil {
+		return Event{}, err
+	}
+	e.Callstack = s.callstack(&e.Ann)
+
+	return e, nil
+}
+
+func sourceLocation(sl *pp.SourceLocation) SourceLocation {
+	return SourceLocation{File: sl.GetFileName(), Function: sl.GetFunctionName(), Line: sl.GetLineNumber()}
+}
+
+// extraCounters returns the values of the extra counters of an event,
+// taking the uuids from the defaults of the sequence if the event
+// doesn't have them.
+func (s *readSequence) extraCounters(te *pp.TrackEvent) ([]CounterSample, error) {
+	var cs []CounterSample
+	ids := te.GetExtraCounterTrackUuids()
+	if len(ids) == 0 {
+		ids = s.counterDefaults
+	}
+	if len(ids) < len(te.GetExtraCounterValues()) {
+		return nil, fmt.Errorf("%d extra counter values, but only %d uuids", len(te.GetExtraCounterValues()), len(ids))
+	}
+	for i, v := range te.GetExtraCounterValues() {
+		if s.incr[ids[i]] {
+			v += s.counters[ids[i]]
+			s.counters[ids[i]] = v
+		}
+		cs = append(cs, CounterSample{TrackUuid: ids[i], Value: v})
+	}
+	fids := te.GetExtraDoubleCounterTrackUuids()
+	if len(fids) == 0 {
+		fids = s.floatCounterDefaults
+	}
+	if len(fids) < len(te.GetExtraDoubleCounterValues()) {
+		return nil, fmt.Errorf("%d extra double counter values, but only %d uuids", len(te.GetExtraDoubleCounterValues()), len(fids))
+	}
+	for i, v := range te.GetExtraDoubleCounterValues() {
+		if s.incr[fids[i]] {
+			v += s.fcounters[fids[i]]
+			s.fcounters[fids[i]] = v
+		}
+		cs = append(cs, CounterSample{TrackUuid: fids[i], IsFloat: true, FloatVal: v})
+	}
+	return cs, nil
+}
+
+// callstack returns the callstack referred to by the iid of the
+// callstack annotation, and removes the annotation from ann. The
+// annotation is always the last one of an event, so user annotations
+// with the same name, or that don't refer to a known callstack, are
+// left in ann.
+func (s *readSequence) callstack(ann *Annotations) []Frame {
+	if len(*ann) == 0 {
+		return nil
+	}
+	last := (*ann)[len(*ann)-1]
+	if last.K != callstackAnnotation {
+		return nil
+	}
+	dict, _ := last.V.(Annotations)
+	i := slices.IndexFunc(dict, func(kv KV) bool { return kv.K == "iid" })
+	if i < 0 {
+		return nil
+	}
+	iid, ok := dict[i].V.(uint64)
+	if !ok {
+		return nil
+	}
+	frames, ok := s.callstacks[iid]
+	if !ok {
+		return nil
+	}
+	if *ann = (*ann)[:len(*ann)-1]; len(*ann) == 0 {
+		*ann = nil
+	}
+	return frames
+}
+
+func (s *readSequence) annotations(das []*pp.DebugAnnotation) (Annotations, error) {
+	var ann Annotations
+	for _, da := range das {
+		v, err := s.annotation(da)
+		if err != nil {
+			return nil, err
+		}
+		name := da.GetName()
+		if iid := da.GetNameIid(); iid != 0 {
+			var ok bool
+			if name, ok = s.annNames[iid]; !ok {
+				return nil, fmt.Errorf("unknown debug annotation name iid %d", iid)
+			}
+		}
+		ann = append(ann, KV{K: name, V: v})
+	}
+	return ann, nil
+}
+
+// annotation returns the value of a debug annotation. Integers are
+// returned as int64 or uint64, floating point numbers as float64,
+// dicts as Annotations and arrays as []any.
+func (s *readSequence) annotation(da *pp.DebugAnnotation) (any, error) {
+	switch v := da.GetValue().(type) {
+	case *pp.DebugAnnotation_BoolValue:
+		return v.BoolValue, nil
+	case *pp.DebugAnnotation_UintValue:
+		return v.UintValue, nil
+	case *pp.DebugAnnotation_IntValue:
+		return v.IntValue, nil
+	case *pp.DebugAnnotation_DoubleValue:
+		return v.DoubleValue, nil
+	case *pp.DebugAnnotation_PointerValue:
+		return Pointer(v.PointerValue), nil
+	case *pp.DebugAnnotation_LegacyJsonValue:
+		return JSON(v.LegacyJsonValue), nil
+	case *pp.DebugAnnotation_StringValue:
+		return v.StringValue, nil
+	case *pp.DebugAnnotation_StringValueIid:
+		str, ok := s.annValues[v.StringValueIid]
+		if !ok {
+			return nil, fmt.Errorf("unknown debug annotation value iid %d", v.StringValueIid)
+		}
+		return str, nil
+	}
+
+	switch {
+	case len(da.GetDictEntries()) > 0:
+		return s.annotations(da.GetDictEntries())
+	case len(da.GetArrayValues()) > 0:
+		var arr []any
+		for _, av := range da.GetArrayValues() {
+			v, err := s.annotation(av)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	}
+	return nil, nil
+}
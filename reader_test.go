@@ -0,0 +1,237 @@
+package perfetto
+
+import (
+	"bytes"
+	"reflect"
+	"slices"
+	"testing"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Tracks are decoded with their kind
+func TestReadTracks(t *testing.T) {
+	trace := NewTrace()
+	bt := trace.AddTrack("track #1")
+	p := trace.AddProcess(1, "process #1")
+	th := trace.AddThread(1, 2, "Thread #1")
+	c := trace.AddCounter("cpu load", "%")
+
+	td := ReadBack(t, trace)
+	AssertEq("Tracks", t, len(td.Tracks), 1)
+	AssertEq("Track", t, td.Tracks[0], bt)
+	AssertEq("Processes", t, len(td.Processes), 1)
+	if !reflect.DeepEqual(td.Processes[0], p) {
+		t.Errorf("For %s\ngot %+v\nexp %+v", "Process", td.Processes[0], p)
+	}
+	AssertEq("Threads", t, len(td.Threads), 1)
+	AssertEq("Thread", t, td.Threads[0], th)
+	AssertEq("Counters", t, len(td.Counters), 1)
+	if !reflect.DeepEqual(td.Counters[0], c) {
+		t.Errorf("For %s\ngot %+v\nexp %+v", "Counter", td.Counters[0], c)
+	}
+}
+
+// Events read back are the same that were added, with every
+// combination of features
+func TestReadEvents(t *testing.T) {
+	for _, feat := range []Features{
+		DefaultFeatures,
+		{Interning: false, IncrementalTS: true},
+		{Interning: true, IncrementalTS: false},
+		{Interning: false, IncrementalTS: false},
+	} {
+		trace := AddManyEvents(t, feat)
+		td := ReadBack(t, trace)
+		AssertEq("Events", t, len(td.Events), 2*100+10)
+
+		t1, t2 := td.Threads[0].Uuid, td.Threads[1].Uuid
+		for i, e := range td.Events[:200] {
+			j := uint64(i / 2)
+			exp := Event{Timestamp: j * 100, Type: pp.TrackEvent_TYPE_SLICE_BEGIN}
+			if j%2 == 0 {
+				exp.Name, exp.TrackUuid = "t1 func", t1
+			} else {
+				exp.Name, exp.TrackUuid = "t2 func", t2
+			}
+			if i%2 == 1 {
+				exp.Timestamp += 50
+				exp.Name, exp.Type = "", pp.TrackEvent_TYPE_SLICE_END
+			}
+			AssertEvent(t, e, exp)
+		}
+		for i, e := range td.Events[200:] {
+			AssertEvent(t, e, Event{
+				Timestamp: uint64(i) * 100,
+				Name:      "Instant event",
+				Type:      pp.TrackEvent_TYPE_INSTANT,
+				TrackUuid: t1,
+			})
+		}
+	}
+}
+
+func TestReadCounter(t *testing.T) {
+	trace := NewTrace()
+	c := trace.AddCounter("cpu load", "%")
+	for i := range uint64(10) {
+		trace.NewValue(c, 100*i, int64(10*i))
+	}
+
+	td := ReadBack(t, trace)
+	AssertEq("Events", t, len(td.Events), 10)
+	for i, e := range td.Events {
+		AssertEvent(t, e, Event{
+			Timestamp: 100 * uint64(i),
+			Name:      "cpu load",
+			Type:      pp.TrackEvent_TYPE_COUNTER,
+			IsCounter: true,
+			Value:     10 * int64(i),
+			TrackUuid: c.Uuid,
+		})
+	}
+}
+
+func TestReadAnnotationsAndFlows(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	ann := Annotations{{"k1", "v1"}, {"k2", "v2"}, {"k3", "v1"}}
+	trace.StartSliceWithFlow(t1, 100, "func", []uint64{1, 2}, ann)
+	trace.EndSliceWithFlow(t1, 200, []uint64{3})
+
+	td := ReadBack(t, trace)
+	AssertEq("Events", t, len(td.Events), 2)
+	if got := td.Events[0].Ann; !slices.Equal(got, ann) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Annotations", got, ann)
+	}
+	if got := td.Events[0].Flows; !slices.Equal(got, []uint64{1, 2}) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Flows", got, []uint64{1, 2})
+	}
+	if got := td.Events[1].Flows; !slices.Equal(got, []uint64{3}) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Flows", got, []uint64{3})
+	}
+}
+
+// Interning and timestamps are resolved per sequence, and across
+// chunks of a streaming trace
+func TestReadSequencesAndChunks(t *testing.T) {
+	var buf bytes.Buffer
+	trace := NewStreamingTrace(&buf)
+	t1 := trace.AddTrack("track #1")
+	seq := trace.NewSequence()
+
+	trace.StartSlice(t1, 1000, "func1")
+	seq.StartSlice(t1, 100, "func2")
+	seq.EndSlice(t1, 200)
+	trace.EndSlice(t1, 2000)
+	trace.Reset()
+	seq.InstantEvent(t1, 300, "func3")
+	trace.InstantEvent(t1, 400, "func4")
+
+	td, err := ReadTrace(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEq("Tracks", t, len(td.Tracks), 1)
+	exp := []Event{
+		{Timestamp: 1000, Name: "func1", Type: pp.TrackEvent_TYPE_SLICE_BEGIN},
+		{Timestamp: 100, Name: "func2", Type: pp.TrackEvent_TYPE_SLICE_BEGIN},
+		{Timestamp: 200, Type: pp.TrackEvent_TYPE_SLICE_END},
+		{Timestamp: 2000, Type: pp.TrackEvent_TYPE_SLICE_END},
+		{Timestamp: 300, Name: "func3", Type: pp.TrackEvent_TYPE_INSTANT},
+		{Timestamp: 400, Name: "func4", Type: pp.TrackEvent_TYPE_INSTANT},
+	}
+	AssertEq("Events", t, len(td.Events), len(exp))
+	for i := range exp {
+		exp[i].TrackUuid = t1.Uuid
+		AssertEvent(t, td.Events[i], exp[i])
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	// an event using an interned name that was never emitted
+	te := &pp.TrackEvent{NameField: &pp.TrackEvent_NameIid{NameIid: 7}}
+	data, err := proto.Marshal(&pp.Trace{
+		Packet: []*pp.TracePacket{{Data: &pp.TracePacket_TrackEvent{TrackEvent: te}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadTrace(bytes.NewReader(data)); err == nil {
+		t.Errorf("expected an error for an unknown name iid")
+	}
+
+	if _, err := ReadTrace(bytes.NewReader([]byte{0xff})); err == nil {
+		t.Errorf("expected an error for a malformed trace")
+	}
+}
+
+// Callstacks are recovered from the interned frames, function names
+// and mappings
+func TestReadCallstack(t *testing.T) {
+	u64 := proto.Uint64
+	data := &pp.InternedData{
+		FunctionNames: []*pp.InternedString{{Iid: u64(1), Str: []byte("main.main")}, {Iid: u64(2), Str: []byte("main.work")}},
+		MappingPaths:  []*pp.InternedString{{Iid: u64(1), Str: []byte("usr")}, {Iid: u64(2), Str: []byte("bin")}},
+		Mappings:      []*pp.Mapping{{Iid: u64(1), PathStringIds: []uint64{1, 2}}},
+		Frames: []*pp.Frame{
+			{Iid: u64(1), FunctionNameId: u64(1), MappingId: u64(1), RelPc: u64(0x10)},
+			{Iid: u64(2), FunctionNameId: u64(2), MappingId: u64(1), RelPc: u64(0x20)},
+		},
+		Callstacks: []*pp.Callstack{{Iid: u64(1), FrameIds: []uint64{1, 2}}},
+	}
+	te := &pp.TrackEvent{DebugAnnotations: []*pp.DebugAnnotation{{
+		NameField: &pp.DebugAnnotation_Name{Name: "callstack"},
+		DictEntries: []*pp.DebugAnnotation{{
+			NameField: &pp.DebugAnnotation_Name{Name: "iid"},
+			Value:     &pp.DebugAnnotation_UintValue{UintValue: 1},
+		}},
+	}}}
+	buf, err := proto.Marshal(&pp.Trace{Packet: []*pp.TracePacket{{
+		Data:          &pp.TracePacket_TrackEvent{TrackEvent: te},
+		InternedData:  data,
+		SequenceFlags: proto.Uint32(uint32(pp.TracePacket_SEQ_INCREMENTAL_STATE_CLEARED)),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	td, err := ReadTrace(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Frame{
+		{Function: "main.main", PC: 0x10, Mapping: "usr/bin"},
+		{Function: "main.work", PC: 0x20, Mapping: "usr/bin"},
+	}
+	if got := td.Events[0].Callstack; !slices.Equal(got, exp) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Callstack", got, exp)
+	}
+	AssertEq("Ann", t, len(td.Events[0].Ann), 0)
+}
+
+// ---- { testing helpers } --------------------------------
+
+func ReadBack(t *testing.T, trace Trace) *TraceData {
+	t.Helper()
+	data, err := trace.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	td, err := ReadTrace(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return td
+}
+
+func AssertEvent(t *testing.T, got, exp Event) {
+	t.Helper()
+	if got.Timestamp != exp.Timestamp || got.Clock != exp.Clock || got.Name != exp.Name ||
+		got.Type != exp.Type || got.IsCounter != exp.IsCounter ||
+		got.Value != exp.Value || got.IsFloat != exp.IsFloat ||
+		got.FloatVal != exp.FloatVal || got.TrackUuid != exp.TrackUuid {
+		t.Errorf("For %s\ngot %+v\nexp %+v", "Event", got, exp)
+	}
+}
@@ -0,0 +1,157 @@
+package perfetto
+
+import (
+	"math/rand/v2"
+	"slices"
+)
+
+// -- { Registry } --------------------------------
+
+// registry holds the tracks added to a trace, so that they can be
+// looked up. It's protected by the mutex of the trace state.
+type registry struct {
+	tracks    []Track             // in emission order
+	uuids     map[uint64]Track    // by uuid
+	processes map[int32]Process   // by pid
+	threads   map[[2]int32]Thread // by (pid, tid)
+	names     map[string][]Track  // by name, in emission order
+}
+
+// reserve gives bt a new uuid if its uuid is already taken by another
+// track of the trace, or by the global track.
+func (r *registry) reserve(bt *BasicTrack) {
+	for bt.Uuid == 0 || r.uuids[bt.Uuid] != nil {
+		bt.Uuid = rand.Uint64()
+	}
+}
+
+// add adds tr, that has a reserved uuid, to the registry.
+func (r *registry) add(tr Track) {
+	if r.uuids == nil {
+		r.uuids = make(map[uint64]Track)
+		r.processes = make(map[int32]Process)
+		r.threads = make(map[[2]int32]Thread)
+		r.names = make(map[string][]Track)
+	}
+	r.tracks = append(r.tracks, tr)
+	r.uuids[tr.GetUuid()] = tr
+	r.names[tr.GetName()] = append(r.names[tr.GetName()], tr)
+	switch tr := tr.(type) {
+	case Process:
+		r.processes[tr.Pid] = tr
+	case Thread:
+		r.threads[[2]int32{tr.Pid, tr.Tid}] = tr
+	}
+}
+
+// replace replaces the track with the same uuid as tr, that was
+// renamed.
+func (r *registry) replace(tr Track) {
+	uuid := tr.GetUuid()
+	old, ok := r.uuids[uuid]
+	if !ok {
+		r.add(tr)
+		return
+	}
+	sameUuid := func(t Track) bool { return t.GetUuid() == uuid }
+	r.tracks[slices.IndexFunc(r.tracks, sameUuid)] = tr
+	r.uuids[uuid] = tr
+	r.names[old.GetName()] = slices.DeleteFunc(r.names[old.GetName()], sameUuid)
+	r.names[tr.GetName()] = append(r.names[tr.GetName()], tr)
+	switch tr := tr.(type) {
+	case Process:
+		if r.processes[tr.Pid].Uuid == uuid {
+			r.processes[tr.Pid] = tr
+		}
+	case Thread:
+		if key := [2]int32{tr.Pid, tr.Tid}; r.threads[key].Uuid == uuid {
+			r.threads[key] = tr
+		}
+	}
+}
+
+// end removes tr, that has ended, from the lookups by pid and tid, so
+// that its ids can be reused by another process or thread.
+func (r *registry) end(tr Track) {
+	switch tr := tr.(type) {
+	case Process:
+		if r.processes[tr.Pid].Uuid == tr.Uuid {
+			delete(r.processes, tr.Pid)
+		}
+	case Thread:
+		if key := [2]int32{tr.Pid, tr.Tid}; r.threads[key].Uuid == tr.Uuid {
+			delete(r.threads, key)
+		}
+	}
+}
+
+// Process returns the process with the given pid, and whether the
+// trace has one. If the pid was added more than once, it returns the
+// last process added.
+func (t *Trace) Process(pid int32) (Process, bool) {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	p, ok := t.st.reg.processes[pid]
+	return p, ok
+}
+
+// Thread returns the thread with the given pid and tid, and whether
+// the trace has one. If the thread was added more than once, it
+// returns the last thread added.
+func (t *Trace) Thread(pid, tid int32) (Thread, bool) {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	th, ok := t.st.reg.threads[[2]int32{pid, tid}]
+	return th, ok
+}
+
+// TrackByUuid returns the track with the given uuid, and whether the
+// trace has one. The track is a BasicTrack, a Process, a Thread or a
+// Counter.
+func (t *Trace) TrackByUuid(uuid uint64) (Track, bool) {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	tr, ok := t.st.reg.uuids[uuid]
+	return tr, ok
+}
+
+// TracksByName returns the tracks with the given name, in the order
+// they were added to the trace.
+func (t *Trace) TracksByName(name string) []Track {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	return append([]Track(nil), t.st.reg.names[name]...)
+}
+
+// Tracks returns all the tracks of the trace, in the order their
+// descriptors were emitted. That includes the tracks added for the
+// lanes of async slices.
+func (t *Trace) Tracks() []Track {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	return append([]Track(nil), t.st.reg.tracks...)
+}
+
+// GetOrAddProcess returns the process with the given pid, adding it
+// to the trace with the given name and options if there's none. It
+// never emits the descriptor of a process twice.
+func (t *Trace) GetOrAddProcess(pid int32, name string, opts ...TrackOption) Process {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	if p, ok := t.st.reg.processes[pid]; ok {
+		return p
+	}
+	return t.addProcess(NewProcess(pid, name, opts...))
+}
+
+// GetOrAddThread returns the thread with the given pid and tid, adding
+// it to the trace with the given name and options if there's none. It
+// never emits the descriptor of a thread twice.
+func (t *Trace) GetOrAddThread(pid, tid int32, name string, opts ...TrackOption) Thread {
+	t.st.mu.Lock()
+	defer t.st.mu.Unlock()
+	if th, ok := t.st.reg.threads[[2]int32{pid, tid}]; ok {
+		return th
+	}
+	return t.addThread(NewThread(pid, tid, name, opts...))
+}
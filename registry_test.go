@@ -0,0 +1,80 @@
+package perfetto
+
+import (
+	"slices"
+	"testing"
+)
+
+// Threads with the same tid in different processes don't collide
+func TestRegistryLookup(t *testing.T) {
+	trace := NewTrace()
+	p1 := trace.AddProcess(1, "process #1")
+	p2 := trace.AddProcess(2, "process #2")
+	t1 := trace.AddThread(1, 10, "worker")
+	t2 := trace.AddThread(2, 10, "worker")
+	c := trace.AddCounter("cpu load", "%")
+	lane := mustBeginAsync(t, trace, p1, 100, "request").Track
+
+	for _, tc := range []struct {
+		pid, tid int32
+		exp      Thread
+	}{{1, 10, t1}, {2, 10, t2}} {
+		th, ok := trace.Thread(tc.pid, tc.tid)
+		AssertEq("Found", t, ok, true)
+		AssertEq("Thread", t, th, tc.exp)
+	}
+	if _, ok := trace.Thread(3, 10); ok {
+		t.Errorf("found a thread of a process that was never added")
+	}
+	p, ok := trace.Process(2)
+	AssertEq("Found", t, ok, true)
+	AssertEq("Process", t, p.Uuid, p2.Uuid)
+
+	tr, ok := trace.TrackByUuid(c.Uuid)
+	AssertEq("Found", t, ok, true)
+	AssertEq("Counter", t, tr.GetName(), "cpu load")
+	if got := trace.TracksByName("worker"); !slices.Equal(got, []Track{t1, t2}) {
+		t.Errorf("For %s\ngot %v\nexp %v", "TracksByName", got, []Track{t1, t2})
+	}
+
+	var got []uint64
+	for _, tr := range trace.Tracks() {
+		got = append(got, tr.GetUuid())
+	}
+	exp := []uint64{p1.Uuid, p2.Uuid, t1.Uuid, t2.Uuid, c.Uuid, lane.Uuid}
+	if !slices.Equal(got, exp) {
+		t.Errorf("For %s\ngot %v\nexp %v", "Tracks", got, exp)
+	}
+}
+
+// GetOrAdd methods emit each descriptor only once
+func TestGetOrAddThread(t *testing.T) {
+	trace := NewTrace()
+	p := trace.GetOrAddProcess(1, "process #1")
+	th := trace.GetOrAddThread(1, 10, "thread")
+	for range 10 {
+		AssertEq("Process", t, trace.GetOrAddProcess(1, "process #1").Uuid, p.Uuid)
+		AssertEq("Thread", t, trace.GetOrAddThread(1, 10, "other name"), th)
+	}
+	AssertNeq("Thread", t, trace.GetOrAddThread(2, 10, "thread").Uuid, th.Uuid)
+
+	td := ReadBack(t, trace)
+	AssertEq("Processes", t, len(td.Processes), 1)
+	AssertEq("Threads", t, len(td.Threads), 2)
+}
+
+// Tracks never get the uuid of another track
+func TestUuidCollision(t *testing.T) {
+	var r registry
+	tr := BasicTrack{Name: "track #1", Uuid: 42}
+	r.reserve(&tr)
+	r.add(tr)
+	AssertEq("Uuid", t, tr.Uuid, uint64(42))
+
+	dup := BasicTrack{Name: "track #2", Uuid: 42}
+	r.reserve(&dup)
+	AssertNeq("Uuid", t, dup.Uuid, uint64(42))
+	global := BasicTrack{Name: "track #3"}
+	r.reserve(&global)
+	AssertNeq("Uuid", t, global.Uuid, uint64(0))
+}
@@ -0,0 +1,182 @@
+package perfetto
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+)
+
+// -- { slog Handler } --------------------------------
+
+type trackKey struct{}
+
+// ContextWithTrack returns a copy of ctx that carries track. Records
+// logged with the context by a SlogHandler are added to the track:
+// since goroutines have no local storage, this is how a goroutine
+// makes its logs appear on its own track.
+func ContextWithTrack(ctx context.Context, track Track) context.Context {
+	return context.WithValue(ctx, trackKey{}, track)
+}
+
+// TrackFromContext returns the track carried by ctx, if any.
+func TrackFromContext(ctx context.Context) (Track, bool) {
+	track, ok := ctx.Value(trackKey{}).(Track)
+	return track, ok
+}
+
+// SlogOptions are the options of a SlogHandler.
+type SlogOptions struct {
+	// Level is the minimum level of the records added to the trace.
+	// If nil, the handler uses slog.LevelInfo.
+	Level slog.Leveler
+
+	// Track is the track of the records whose context doesn't carry
+	// one. If nil, those records are dropped.
+	Track Track
+
+	// Timestamp converts the time of a record to a trace timestamp.
+	// If nil, the handler uses the Timestamp method of the trace.
+	// It's not called for records with a zero time, which get a zero
+	// timestamp.
+	Timestamp func(time.Time) uint64
+}
+
+// SlogHandler is a slog.Handler that adds the records to a trace as
+// log messages. Levels are mapped to log priorities, and attributes to
+// debug annotations. If the SourceLocations feature of the trace is
+// enabled, the source location of the records is recorded too.
+type SlogHandler struct {
+	trace  *Trace
+	opts   SlogOptions
+	groups []string    // groups opened by WithGroup
+	attrs  Annotations // attributes added by WithAttrs, nested in their groups
+}
+
+// NewSlogHandler returns a SlogHandler that adds the records to the
+// trace, on the sequence of t. opts can be nil.
+func (t *Trace) NewSlogHandler(opts *SlogOptions) *SlogHandler {
+	h := &SlogHandler{trace: t}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.Level == nil {
+		h.opts.Level = slog.LevelInfo
+	}
+	if h.opts.Timestamp == nil {
+		h.opts.Timestamp = t.Timestamp
+	}
+	return h
+}
+
+func (h *SlogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.opts.Level.Level()
+}
+
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	track, ok := TrackFromContext(ctx)
+	if !ok {
+		track = h.opts.Track
+	}
+	if track == nil {
+		return nil
+	}
+
+	var attrs []slog.Attr
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	ann := nest(h.attrs, h.groups, slogAnnotations(attrs))
+
+	var ts uint64
+	if !r.Time.IsZero() {
+		ts = h.opts.Timestamp(r.Time)
+	}
+	e := NewEvent(track, pp.TrackEvent_TYPE_INSTANT, ts, "LogMessage", nil, ann)
+	e.Log = &LogMessage{Priority: slogPriority(r.Level), Body: r.Message}
+	if h.trace.features.SourceLocations {
+		e.pc = r.PC
+	}
+	return h.trace.AddEvent(e)
+}
+
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = nest(h.attrs, h.groups, slogAnnotations(attrs))
+	return &h2
+}
+
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.groups = slices.Concat(h.groups, []string{name})
+	return &h2
+}
+
+// slogPriority returns the log priority of a slog level.
+func slogPriority(l slog.Level) Priority {
+	switch {
+	case l < slog.LevelDebug:
+		return PrioVerbose
+	case l < slog.LevelInfo:
+		return PrioDebug
+	case l < slog.LevelWarn:
+		return PrioInfo
+	case l < slog.LevelError:
+		return PrioWarn
+	default:
+		return PrioError
+	}
+}
+
+// slogAnnotations returns the annotations of slog attributes, following
+// the rules of slog.Handler: empty attributes are ignored, groups are
+// nested dicts, and groups with an empty key are inlined.
+func slogAnnotations(attrs []slog.Attr) Annotations {
+	var ann Annotations
+	for _, a := range attrs {
+		v := a.Value.Resolve()
+		switch {
+		case a.Equal(slog.Attr{}):
+			continue
+		case v.Kind() == slog.KindGroup:
+			g := slogAnnotations(v.Group())
+			if len(g) == 0 {
+				continue
+			}
+			if a.Key == "" {
+				ann = append(ann, g...)
+			} else {
+				ann = append(ann, KV{K: a.Key, V: g})
+			}
+		default:
+			ann = append(ann, KV{K: a.Key, V: v.Any()})
+		}
+	}
+	return ann
+}
+
+// nest returns a copy of ann with kvs appended to the dict found
+// following the groups path, which is created if needed. ann is not
+// modified.
+func nest(ann Annotations, groups []string, kvs Annotations) Annotations {
+	if len(kvs) == 0 {
+		return ann
+	}
+	if len(groups) == 0 {
+		return slices.Concat(ann, kvs)
+	}
+	ann = slices.Clone(ann)
+	for i := range ann {
+		if sub, ok := ann[i].V.(Annotations); ok && ann[i].K == groups[0] {
+			ann[i].V = nest(sub, groups[1:], kvs)
+			return ann
+		}
+	}
+	return append(ann, KV{K: groups[0], V: nest(nil, groups[1:], kvs)})
+}
@@ -0,0 +1,97 @@
+package perfetto
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"testing/slogtest"
+	"time"
+)
+
+// Turns annotations into the maps expected by slogtest
+func annotationsMap(ann Annotations) map[string]any {
+	m := make(map[string]any)
+	for _, kv := range ann {
+		if sub, ok := kv.V.(Annotations); ok {
+			m[kv.K] = annotationsMap(sub)
+		} else {
+			m[kv.K] = kv.V
+		}
+	}
+	return m
+}
+
+func TestSlogHandler(t *testing.T) {
+	var trace Trace
+	slogtest.Run(t, func(t *testing.T) slog.Handler {
+		trace = NewTrace()
+		return trace.NewSlogHandler(&SlogOptions{Track: trace.AddTrack("logs")})
+	}, func(t *testing.T) map[string]any {
+		td := ReadBack(t, trace)
+		if len(td.Events) != 1 {
+			t.Fatalf("got %d events, exp 1", len(td.Events))
+		}
+		e := td.Events[0]
+		m := annotationsMap(e.Ann)
+		m[slog.MessageKey] = e.Log.Body
+		m[slog.LevelKey] = e.Log.Priority
+		if e.Timestamp != 0 {
+			m[slog.TimeKey] = trace.st.epoch.Add(time.Duration(e.Timestamp))
+		}
+		return m
+	})
+}
+
+// Records are added to the track of the context, and levels are
+// mapped to priorities
+func TestSlogHandlerTracks(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	t2 := trace.AddTrack("track #2")
+	logger := slog.New(trace.NewSlogHandler(&SlogOptions{Track: t1, Level: slog.LevelDebug}))
+
+	ctx := ContextWithTrack(context.Background(), t2)
+	logger.DebugContext(ctx, "debug")
+	logger.Info("info")
+	logger.WarnContext(ctx, "warn")
+	logger.Log(ctx, slog.LevelDebug-4, "verbose") // below the level
+	logger.With("request", 1).WithGroup("db").Error("error", "table", "users")
+
+	td := ReadBack(t, trace)
+	AssertEq("Events", t, len(td.Events), 4)
+	for i, exp := range []struct {
+		track uint64
+		prio  Priority
+	}{
+		{t2.Uuid, PrioDebug}, {t1.Uuid, PrioInfo}, {t2.Uuid, PrioWarn}, {t1.Uuid, PrioError},
+	} {
+		AssertEq("TrackUuid", t, td.Events[i].TrackUuid, exp.track)
+		AssertEq("Priority", t, td.Events[i].Log.Priority, exp.prio)
+	}
+	m := annotationsMap(td.Events[3].Ann)
+	AssertEq("request", t, m["request"], any(int64(1)))
+	AssertEq("db.table", t, m["db"].(map[string]any)["table"], any("users"))
+}
+
+// Without a default track, records logged without a track are dropped
+func TestSlogHandlerNoTrack(t *testing.T) {
+	trace := NewTrace()
+	logger := slog.New(trace.NewSlogHandler(nil))
+	logger.Info("dropped")
+
+	td := ReadBack(t, trace)
+	AssertEq("Events", t, len(td.Events), 0)
+}
+
+// Records are timestamped by the clock of the trace by default
+func TestSlogHandlerTimestamp(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	feat := DefaultFeatures
+	feat.Clock = clock
+	trace := NewTrace(feat)
+	h := trace.NewSlogHandler(&SlogOptions{Track: trace.AddTrack("logs")})
+	h.Handle(context.Background(), slog.NewRecord(clock.now.Add(100), slog.LevelInfo, "info", 0))
+
+	td := ReadBack(t, trace)
+	AssertEq("Timestamp", t, td.Events[0].Timestamp, 100)
+}
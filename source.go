@@ -0,0 +1,85 @@
+package perfetto
+
+import (
+	"runtime"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	pp "github.com/ALTree/perfetto/internal/proto"
+)
+
+// -- { Source Locations } --------------------------------
+
+// SourceLocation is the place in the source code that emitted an
+// event.
+type SourceLocation struct {
+	File     string
+	Function string
+	Line     uint32
+}
+
+// Source returns an EventOption that sets the source location of an
+// event, overriding the one captured by the SourceLocations feature.
+// It's useful for generated code and for wrappers of the Trace
+// methods, whose own location is not interesting.
+func Source(loc SourceLocation) EventOption {
+	return func(e *Event) { e.Location = loc }
+}
+
+func (loc SourceLocation) emit() *pp.SourceLocation {
+	return &pp.SourceLocation{
+		FileName:     proto.String(loc.File),
+		FunctionName: proto.String(loc.Function),
+		LineNumber:   proto.Uint32(loc.Line),
+	}
+}
+
+// setCaller records the caller of an exported Trace method as the
+// source location of e, if the SourceLocations feature is enabled,
+// and its callstack, if callstacks are captured for e. skip is the
+// number of frames between the exported method and setCaller. Only
+// the pcs are captured here: they are resolved when the event is
+// emitted. It must be called with the options of the handle already
+// applied to e, and with the trace lock held.
+func (t *Trace) setCaller(e *Event, skip int) {
+	// skip runtime.Callers, setCaller and the Trace method
+	skip += 3
+	if t.features.SourceLocations {
+		var pcs [1]uintptr
+		if runtime.Callers(skip, pcs[:]) > 0 {
+			e.pc = pcs[0]
+		}
+	}
+	if t.st.callstacks.enabled(e.Categories) {
+		pcs := make([]uintptr, t.st.callstacks.depth)
+		e.stack = pcs[:runtime.Callers(skip, pcs)]
+	}
+}
+
+// locations caches the SourceLocation of the pcs resolved so far.
+var locations sync.Map // uintptr -> SourceLocation
+
+// pcLocation returns the source location of pc.
+func pcLocation(pc uintptr) SourceLocation {
+	if loc, ok := locations.Load(pc); ok {
+		return loc.(SourceLocation)
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	loc := SourceLocation{File: frame.File, Function: frame.Function, Line: uint32(frame.Line)}
+	locations.Store(pc, loc)
+	return loc
+}
+
+// sourceLocationIid returns the iid of the source location, interning
+// it if needed.
+func (s *sequence) sourceLocationIid(loc SourceLocation) uint64 {
+	iid, ok := intern(s.interning.SourceLocations, &s.interning.NextSourceLocationId, loc)
+	if ok {
+		d := s.internedData()
+		sl := loc.emit()
+		sl.Iid = proto.Uint64(iid)
+		d.SourceLocations = append(d.SourceLocations, sl)
+	}
+	return iid
+}
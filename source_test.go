@@ -0,0 +1,60 @@
+package perfetto
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSourceLocations(t *testing.T) {
+	for _, feat := range []Features{
+		{Interning: true, IncrementalTS: true, SourceLocations: true},
+		{SourceLocations: true},
+	} {
+		trace := NewTrace(feat)
+		t1 := trace.AddTrack("track #1")
+
+		_, file, line, _ := runtime.Caller(0)
+		for range 2 {
+			trace.InstantEvent(t1, 100, "instant") // line+2
+		}
+		trace.StartSlice(t1, 200, "slice") // line+4
+		trace.EndSlice(t1, 300)
+		gen := SourceLocation{File: "gen.go", Function: "main.generated", Line: 7}
+		trace.With(Source(gen)).InstantEvent(t1, 400, "generated")
+
+		tr := RoundTrip(t, trace)
+		if feat.Interning {
+			AssertEq("interned locations", t, len(tr.Packet[2].GetInternedData().GetSourceLocations()), 1)
+			AssertEq("interned locations", t, len(tr.Packet[3].GetInternedData().GetSourceLocations()), 0)
+		} else {
+			AssertEq("location", t, tr.Packet[1].GetTrackEvent().GetSourceLocation().GetLineNumber(), uint32(line+2))
+		}
+
+		td := ReadBack(t, trace)
+		for i, exp := range []SourceLocation{
+			{File: file, Line: uint32(line + 2)},
+			{File: file, Line: uint32(line + 2)},
+			{File: file, Line: uint32(line + 4)},
+			{},
+			gen,
+		} {
+			got := td.Events[i].Location
+			AssertEq("File", t, got.File, exp.File)
+			AssertEq("Line", t, got.Line, exp.Line)
+			if exp.File == file && !strings.HasSuffix(got.Function, "TestSourceLocations") {
+				t.Errorf("For %s\ngot %v\nexp %v", "Function", got.Function, "TestSourceLocations")
+			}
+		}
+	}
+}
+
+// Without the feature, only explicit locations are emitted
+func TestSourceLocationsDisabled(t *testing.T) {
+	trace := NewTrace()
+	t1 := trace.AddTrack("track #1")
+	trace.InstantEvent(t1, 100, "instant")
+
+	td := ReadBack(t, trace)
+	AssertEq("Location", t, td.Events[0].Location, SourceLocation{})
+}